@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/logging"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
 	"github.com/persona-id/proxysql-agent/internal/proxysql"
 	"github.com/persona-id/proxysql-agent/internal/restapi"
+	"github.com/persona-id/proxysql-agent/internal/tracing"
 )
 
 var (
@@ -21,51 +30,248 @@ var (
 	date = "unknown" //nolint:gochecknoglobals
 )
 
+// Process exit codes. These let alerting distinguish between the different shutdown outcomes.
+const (
+	exitClean          = 0 // clean shutdown, or no run mode specified
+	exitError          = 1 // any other error, such as a bad config or failing to start up
+	exitDrainTimeout   = 3 // clients were still connected when shutdown.drain_timeout expired
+	exitShutdownFailed = 4 // the command to shut down proxysql failed
+)
+
+const (
+	// How long to wait for the buffered spans to be exported on exit.
+	tracingFlushTimeout = 5 * time.Second
+
+	// How long to wait for in-flight API requests to finish on exit.
+	apiShutdownTimeout = 5 * time.Second
+)
+
 func main() {
 	settings, err := configuration.Configure()
 	if err != nil {
 		slog.Error("Error in Configure()", slog.Any("err", err))
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
-	setupLogger(settings)
+	logOutput := setupLogger(settings)
 
 	slog.Info("build info", slog.Any("version", version), slog.Any("committed", date), slog.Any("revision", commit))
 
+	if settings.Log.EffectiveConfig {
+		effective, err := settings.EffectiveJSON()
+		if err != nil {
+			slog.Error("Unable to render the effective configuration", slog.Any("error", err))
+		} else {
+			slog.Info("Effective configuration", slog.String("config", effective))
+		}
+	}
+
+	// cancelled on SIGTERM/SIGINT, which starts a graceful shutdown of the run loops. this is set up before
+	// the start delay, so that a pod killed while it's still starting up exits promptly.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
 	// if defined, pause before booting; this allows the proxysql containers to fully come up before the agent tries
 	// connecting; sometimes the proxysql container can take a few seconds to fully start. This is mainly only
 	// an issue when booting into core or satellite mode; any other commands that might be run ad hoc should be
 	// fine
 	if settings.StartDelay > 0 {
 		slog.Info("Pausing before boot", slog.Int("seconds", settings.StartDelay))
-		time.Sleep(time.Duration(settings.StartDelay) * time.Second)
+
+		if err := startDelay(ctx, time.Duration(settings.StartDelay)*time.Second); err != nil {
+			slog.Info("Shutdown requested during the start delay, exiting")
+			stop()
+			logOutput.Close()
+			os.Exit(exitClean)
+		}
 	}
 
 	var psql *proxysql.ProxySQL
 
-	psql, err = psql.New(settings)
+	psql, err = psql.New(ctx, settings)
+	if err != nil && ctx.Err() != nil {
+		slog.Info("Shutdown requested while connecting to ProxySQL, exiting")
+		stop()
+		logOutput.Close()
+		os.Exit(exitClean)
+	}
+
 	if err != nil {
 		slog.Error("Unable to connect to ProxySQL", slog.Any("error", err))
 		panic(err)
 	}
 
-	// run the process in either core or satellite mode; each of these is a for {} loop,
-	// so it will block the process from exiting
+	go metrics.LogRuntimeStats(ctx, time.Duration(settings.Debug.RuntimeStatsInterval)*time.Second)
+
+	// tracing is optional, so carry on without it rather than refusing to start
+	shutdownTracing, err := tracing.Setup(ctx, settings)
+	if err != nil {
+		slog.Error("Unable to set up tracing", slog.Any("error", err))
+
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	// pick up a rotated admin password, if proxysql.password_file and proxysql.password_reload_interval are set
+	go psql.WatchPasswordFile(ctx)
+
+	// ping the admin interface between probes, if proxysql.keepalive_interval is set
+	go psql.Keepalive(ctx)
+
+	// on SIGUSR1, log the probe results and the server tables, to debug the state of a running pod
+	go handleSIGUSR1(ctx, psql)
+
+	// on SIGUSR2, abort a drain in progress and go back to running, eg: after /shutdown was called by mistake
+	go handleSIGUSR2(ctx, psql)
+
+	build := restapi.BuildInfo{Version: version, Commit: commit, Date: date}
+
+	var server *http.Server
+
+	// run the process in either core or satellite mode; each of these is a loop that blocks the
+	// process from exiting until it is shut down, and returns the result of the shutdown
 	switch settings.RunMode {
 	case "core":
-		go restapi.StartAPI(psql) // start the http api
-		psql.Core()
+		if server, err = restapi.StartAPI(psql, settings, build); err != nil { // start the http api
+			slog.Error("Unable to start the HTTP API", slog.Any("error", err))
+			stop()
+			logOutput.Close()
+			os.Exit(exitError)
+		}
+
+		err = psql.Core(ctx)
 	case "satellite":
-		go restapi.StartAPI(psql) // start the http api
-		psql.Satellite()
+		if server, err = restapi.StartAPI(psql, settings, build); err != nil { // start the http api
+			slog.Error("Unable to start the HTTP API", slog.Any("error", err))
+			stop()
+			logOutput.Close()
+			os.Exit(exitError)
+		}
+
+		err = psql.Satellite(ctx)
 	case "dump":
-		psql.DumpData()
+		// with dump.leader_election, the API is served so that /version shows which agent holds the lease
+		if settings.Dump.Interval > 0 && settings.Dump.LeaderElection {
+			if server, err = restapi.StartAPI(psql, settings, build); err != nil {
+				slog.Error("Unable to start the HTTP API", slog.Any("error", err))
+				stop()
+				logOutput.Close()
+				os.Exit(exitError)
+			}
+		}
+
+		if settings.Dump.Interval > 0 {
+			err = psql.DumpLoop(ctx)
+		} else {
+			_, err = psql.DumpData(ctx)
+		}
 	default:
 		slog.Info("No run mode specified, exiting")
 	}
+
+	stop()
+
+	// let the requests in flight, such as a last probe or the preStop hook's /shutdown, get their responses
+	shutdownAPI(server)
+
+	code := exitCode(err)
+	if code != exitClean {
+		slog.Error("Shutdown did not complete cleanly", slog.Any("error", err), slog.Int("exit_code", code))
+	}
+
+	// flush the buffered spans; ctx is cancelled by now, so give the exporter a few seconds of its own
+	flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Unable to flush the traces", slog.Any("error", err))
+	}
+
+	cancel()
+
+	// os.Exit skips deferred calls, so close the log file explicitly
+	logOutput.Close()
+
+	os.Exit(code)
+}
+
+// Stop the HTTP API, waiting up to apiShutdownTimeout for the requests in flight to finish. There's no server to
+// stop in dump mode, so a nil server is a no-op.
+func shutdownAPI(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Unable to shut down the HTTP API cleanly", slog.Any("error", err))
+	}
+}
+
+// Sleep for the delay, returning early with the context's error if it's cancelled first.
+func startDelay(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Log the probe results and the server tables each time SIGUSR1 is received, until the context is cancelled.
+func handleSIGUSR1(ctx context.Context, psql *proxysql.ProxySQL) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			results, err := psql.RunProbes(ctx)
+			if err != nil {
+				slog.Error("Unable to run probes", slog.Any("error", err))
+			} else {
+				slog.Info("Probe results", slog.Any("results", results))
+			}
+
+			if err := psql.DumpServers(ctx); err != nil {
+				slog.Error("Unable to dump the server tables", slog.Any("error", err))
+			}
+		}
+	}
 }
 
-func setupLogger(settings *configuration.Config) {
+// Resume from a drain each time SIGUSR2 is received, until the context is cancelled. Once the context is cancelled
+// the process is exiting anyway, so a drain started by SIGTERM can't be aborted.
+func handleSIGUSR2(ctx context.Context, psql *proxysql.ProxySQL) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
+	defer signal.Stop(usr2)
+
+	psql.ResumeOnSignal(ctx, usr2)
+}
+
+// Map the result of the run loops onto the process exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitClean
+	case errors.Is(err, proxysql.ErrShutdownFailed):
+		return exitShutdownFailed
+	case errors.Is(err, proxysql.ErrDrainTimeout):
+		return exitDrainTimeout
+	default:
+		return exitError
+	}
+}
+
+// Set up the default logger, and return the log destination so that it can be closed on shutdown.
+func setupLogger(settings *configuration.Config) io.Closer {
 	var level slog.Level
 
 	switch settings.Log.Level {
@@ -86,12 +292,17 @@ func setupLogger(settings *configuration.Config) {
 		Level:     level,
 	}
 
-	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	output := logging.NewWriter(settings.Log.Output, settings.Log.MaxSizeMB, settings.Log.MaxBackups, settings.Log.MaxAgeDays)
+
+	var handler slog.Handler = slog.NewTextHandler(output, opts)
 	if settings.Log.Format == "JSON" {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(output, opts)
 	}
 
-	logger := slog.New(handler)
+	// adds the request ID to log lines emitted while handling API requests
+	logger := slog.New(logging.NewContextHandler(handler))
 
 	slog.SetDefault(logger)
+
+	return output
 }
@@ -1 +1,94 @@
 package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/proxysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"clean shutdown", nil, exitClean},
+		{"drain timed out", proxysql.ErrDrainTimeout, exitDrainTimeout},
+		{"shutdown command failed", fmt.Errorf("%w: invalid connection", proxysql.ErrShutdownFailed), exitShutdownFailed},
+		{"both failed", errors.Join(proxysql.ErrDrainTimeout, proxysql.ErrShutdownFailed), exitShutdownFailed},
+		{"other error", errors.New("informer error"), exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, exitCode(tt.err))
+		})
+	}
+}
+
+func TestStartDelay(t *testing.T) {
+	t.Run("delay elapses", func(t *testing.T) {
+		err := startDelay(context.Background(), 10*time.Millisecond)
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("cancelled during the delay", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		err := startDelay(ctx, time.Minute)
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestShutdownAPI(t *testing.T) {
+	t.Run("no server", func(_ *testing.T) {
+		shutdownAPI(nil)
+	})
+
+	t.Run("waits for requests in flight", func(t *testing.T) {
+		started := make(chan struct{})
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		codes := make(chan int, 1)
+
+		go func() {
+			resp, err := http.Get(ts.URL + "/healthz/ready")
+			if err != nil {
+				codes <- 0
+
+				return
+			}
+
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+
+		<-started
+
+		shutdownAPI(ts.Config)
+
+		assert.Equal(t, http.StatusOK, <-codes)
+	})
+}
@@ -1,34 +1,73 @@
 package configuration
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+var ErrMissingPort = errors.New("proxysql.address must be in the form host:port")
+
+// ErrInvalidTLSConfig is returned from Configure when proxysql.tls is enabled but its files can't be used.
+var ErrInvalidTLSConfig = errors.New("invalid proxysql.tls configuration")
+
 type Config struct {
 	StartDelay int `mapstructure:"start_delay"`
 
 	Log struct {
-		Level  string `mapstructure:"level"`
-		Format string `mapstructure:"format"`
+		Level           string `mapstructure:"level"`
+		Format          string `mapstructure:"format"`
+		Output          string `mapstructure:"output"`
+		EffectiveConfig bool   `mapstructure:"effective_config"`
+		Probes          bool   `mapstructure:"probes"`
+		MaxSizeMB       int    `mapstructure:"max_size_mb"`
+		MaxBackups      int    `mapstructure:"max_backups"`
+		MaxAgeDays      int    `mapstructure:"max_age_days"`
 	} `mapstructure:"log"`
 
 	ProxySQL struct {
-		Address  string `mapstructure:"address"`
-		Username string `mapstructure:"username"`
-		Password string `mapstructure:"password"`
+		Address                string   `mapstructure:"address"`
+		Username               string   `mapstructure:"username"`
+		Password               string   `mapstructure:"password"`
+		PasswordFile           string   `mapstructure:"password_file"`
+		PasswordReloadInterval int      `mapstructure:"password_reload_interval"`
+		KeepaliveInterval      int      `mapstructure:"keepalive_interval"`
+		StartupCommands        []string `mapstructure:"startup_commands"`
+		AdminPort              int      `mapstructure:"admin_port"`
+		ClusterPort            int      `mapstructure:"cluster_port"`
+		ConnectionTag          string   `mapstructure:"connection_tag"`
+		MaxOpenConns           int      `mapstructure:"max_open_conns"`
+		MaxIdleConns           int      `mapstructure:"max_idle_conns"`
+		ConnMaxLifetime        int      `mapstructure:"conn_max_lifetime"`
+		ConnectTimeout         int      `mapstructure:"connect_timeout"`
+		TLS                    struct {
+			Enabled    bool   `mapstructure:"enabled"`
+			CAFile     string `mapstructure:"ca_file"`
+			CertFile   string `mapstructure:"cert_file"`
+			KeyFile    string `mapstructure:"key_file"`
+			SkipVerify bool   `mapstructure:"skip_verify"`
+		} `mapstructure:"tls"`
 	} `mapstructure:"proxysql"`
 
 	RunMode string `mapstructure:"run_mode"`
 
 	Core struct {
-		Interval    int `mapstructure:"interval"`
-		PodSelector struct {
+		Interval       int      `mapstructure:"interval"`
+		InformerResync int      `mapstructure:"informer_resync"`
+		PodAllowlist   []string `mapstructure:"pod_allowlist"`
+		PodSelector    struct {
 			Namespace string `mapstructure:"namespace"`
 			App       string `mapstructure:"app"`
 			Component string `mapstructure:"component"`
@@ -36,9 +75,98 @@ type Config struct {
 	} `mapstructure:"core"`
 
 	Satellite struct {
-		Interval int `mapstructure:"interval"`
+		Interval     int    `mapstructure:"interval"`
+		LastCheckMS  int    `mapstructure:"last_check_ms"`
+		CoreHostname string `mapstructure:"core_hostname"`
 	} `mapstructure:"satellite"`
 
+	Kube struct {
+		ConfigPath string `mapstructure:"config_path"`
+	} `mapstructure:"kube"`
+
+	API struct {
+		MetricsEnabled   bool   `mapstructure:"metrics_enabled"`
+		AuthToken        string `mapstructure:"auth_token"`
+		AuthExemptHealth bool   `mapstructure:"auth_exempt_health"`
+		PprofEnabled     bool   `mapstructure:"pprof_enabled"`
+		ProbeCacheMS     int    `mapstructure:"probe_cache_ms"`
+		ProbeTimeout     int    `mapstructure:"probe_timeout"`
+		TLS              struct {
+			CertFile string `mapstructure:"cert_file"`
+			KeyFile  string `mapstructure:"key_file"`
+		} `mapstructure:"tls"`
+	} `mapstructure:"api"`
+
+	Readiness struct {
+		RequireCoreVisible bool `mapstructure:"require_core_visible"`
+		CheckMonitor       bool `mapstructure:"check_monitor"`
+		MaxLagMS           int  `mapstructure:"max_lag_ms"`
+	} `mapstructure:"readiness"`
+
+	Probes struct {
+		LogProxySQLErrors bool `mapstructure:"log_proxysql_errors"`
+	} `mapstructure:"probes"`
+
+	Dump struct {
+		IncludeConnPool      bool     `mapstructure:"include_conn_pool"`
+		ExpectComponent      string   `mapstructure:"expect_component"`
+		TimeFormat           string   `mapstructure:"time_format"`
+		IncludeClientAddress bool     `mapstructure:"include_client_address"`
+		Tables               []string `mapstructure:"tables"`
+		OutputDir            string   `mapstructure:"output_dir"`
+		Compress             bool     `mapstructure:"compress"`
+		Interval             int      `mapstructure:"interval"`
+		LeaderElection       bool     `mapstructure:"leader_election"`
+		LeaseName            string   `mapstructure:"lease_name"`
+		Reset                struct {
+			Digests bool `mapstructure:"digests"`
+		} `mapstructure:"reset"`
+		Snowflake struct {
+			Account        string `mapstructure:"account"`
+			User           string `mapstructure:"user"`
+			Warehouse      string `mapstructure:"warehouse"`
+			Database       string `mapstructure:"database"`
+			Schema         string `mapstructure:"schema"`
+			Stage          string `mapstructure:"stage"`
+			Table          string `mapstructure:"table"`
+			PrivateKeyFile string `mapstructure:"private_key_file"`
+		} `mapstructure:"snowflake"`
+		S3 struct {
+			Bucket string `mapstructure:"bucket"`
+			Prefix string `mapstructure:"prefix"`
+			Region string `mapstructure:"region"`
+		} `mapstructure:"s3"`
+	} `mapstructure:"dump"`
+
+	Shutdown struct {
+		DrainTimeout         int      `mapstructure:"drain_timeout"`
+		DrainPollInterval    int      `mapstructure:"drain_poll_interval"`
+		PauseRetries         int      `mapstructure:"pause_retries"`
+		MaxDrainLifetime     int      `mapstructure:"max_drain_lifetime"`
+		PhaseWebhookURL      string   `mapstructure:"phase_webhook_url"`
+		VerifyStopped        bool     `mapstructure:"verify_stopped"`
+		VerifyStoppedTimeout int      `mapstructure:"verify_stopped_timeout"`
+		DrainConditions      []string `mapstructure:"drain_conditions"`
+		ProceedFile          string   `mapstructure:"proceed_file"`
+		Command              string   `mapstructure:"command"`
+	} `mapstructure:"shutdown"`
+
+	Debug struct {
+		RuntimeStatsInterval int `mapstructure:"runtime_stats_interval"`
+	} `mapstructure:"debug"`
+
+	Notifications struct {
+		WebhookURL      string `mapstructure:"webhook_url"`
+		AlertWebhookURL string `mapstructure:"alert_webhook_url"`
+		Timeout         int    `mapstructure:"timeout"`
+	} `mapstructure:"notifications"`
+
+	Tracing struct {
+		Enabled    bool    `mapstructure:"enabled"`
+		Endpoint   string  `mapstructure:"endpoint"`
+		SampleRate float64 `mapstructure:"sample_rate"`
+	} `mapstructure:"tracing"`
+
 	Interfaces []string `mapstructure:"interfaces"`
 }
 
@@ -59,29 +187,115 @@ func Configure() (*Config, error) {
 	viper.GetViper().SetDefault("start_delay", 0)
 	viper.GetViper().SetDefault("log.level", "INFO")
 	viper.GetViper().SetDefault("log.format", "text")
+	viper.GetViper().SetDefault("log.output", "stdout")
+	viper.GetViper().SetDefault("log.effective_config", false)
+	viper.GetViper().SetDefault("log.probes", false)
+	viper.GetViper().SetDefault("log.max_size_mb", 100)
+	viper.GetViper().SetDefault("log.max_backups", 3)
+	viper.GetViper().SetDefault("log.max_age_days", 28)
 	viper.GetViper().SetDefault("run_mode", nil)
 
 	// use the dot notation to access nested values
 	viper.GetViper().SetDefault("proxysql.address", "127.0.0.1:6032")
 	viper.GetViper().SetDefault("proxysql.username", "radmin")
 	viper.GetViper().SetDefault("proxysql.password", "")
+	viper.GetViper().SetDefault("proxysql.password_file", "")
+	viper.GetViper().SetDefault("proxysql.password_reload_interval", 0)
+	viper.GetViper().SetDefault("proxysql.keepalive_interval", 0)
+	viper.GetViper().SetDefault("proxysql.startup_commands", []string{})
+	viper.GetViper().SetDefault("proxysql.admin_port", 0)
+	viper.GetViper().SetDefault("proxysql.cluster_port", 0)
+	viper.GetViper().SetDefault("proxysql.connection_tag", "proxysql-agent")
+	viper.GetViper().SetDefault("proxysql.max_open_conns", 0)
+	viper.GetViper().SetDefault("proxysql.max_idle_conns", 2)
+	viper.GetViper().SetDefault("proxysql.conn_max_lifetime", 0)
+	viper.GetViper().SetDefault("proxysql.connect_timeout", 30)
+	viper.GetViper().SetDefault("proxysql.tls.enabled", false)
+	viper.GetViper().SetDefault("proxysql.tls.ca_file", "")
+	viper.GetViper().SetDefault("proxysql.tls.cert_file", "")
+	viper.GetViper().SetDefault("proxysql.tls.key_file", "")
+	viper.GetViper().SetDefault("proxysql.tls.skip_verify", false)
 
 	viper.GetViper().SetDefault("core.interval", 10)
+	viper.GetViper().SetDefault("core.informer_resync", 30)
 	viper.GetViper().SetDefault("core.podselector.namespace", "proxysql")
 	viper.GetViper().SetDefault("core.podselector.app", "proxysql")
 	viper.GetViper().SetDefault("core.podselector.component", "core")
+	viper.GetViper().SetDefault("core.pod_allowlist", []string{})
 
 	viper.GetViper().SetDefault("satellite.interval", 10)
+	viper.GetViper().SetDefault("satellite.last_check_ms", 30000)
+	viper.GetViper().SetDefault("satellite.core_hostname", "proxysql-core")
+
+	viper.GetViper().SetDefault("kube.config_path", "")
+
+	viper.GetViper().SetDefault("api.metrics_enabled", true)
+	viper.GetViper().SetDefault("api.tls.cert_file", "")
+	viper.GetViper().SetDefault("api.tls.key_file", "")
+	viper.GetViper().SetDefault("api.auth_token", "")
+	viper.GetViper().SetDefault("api.auth_exempt_health", true)
+	viper.GetViper().SetDefault("api.pprof_enabled", false)
+	viper.GetViper().SetDefault("api.probe_cache_ms", 1000)
+	viper.GetViper().SetDefault("api.probe_timeout", 2)
+
+	viper.GetViper().SetDefault("readiness.require_core_visible", false)
+	viper.GetViper().SetDefault("readiness.check_monitor", false)
+	viper.GetViper().SetDefault("readiness.max_lag_ms", 0)
+
+	viper.GetViper().SetDefault("probes.log_proxysql_errors", false)
+
+	viper.GetViper().SetDefault("dump.include_conn_pool", false)
+	viper.GetViper().SetDefault("dump.reset.digests", false)
+	viper.GetViper().SetDefault("dump.expect_component", "")
+	viper.GetViper().SetDefault("dump.time_format", "rfc3339")
+	viper.GetViper().SetDefault("dump.include_client_address", false)
+	viper.GetViper().SetDefault("dump.tables", []string{"query_digest", "query_rules", "query_rule_stats"})
+	viper.GetViper().SetDefault("dump.output_dir", "/tmp")
+	viper.GetViper().SetDefault("dump.compress", false)
+	viper.GetViper().SetDefault("dump.interval", 0)
+	viper.GetViper().SetDefault("dump.leader_election", false)
+	viper.GetViper().SetDefault("dump.lease_name", "proxysql-agent-dump")
+	viper.GetViper().SetDefault("dump.snowflake.account", "")
+	viper.GetViper().SetDefault("dump.snowflake.user", "")
+	viper.GetViper().SetDefault("dump.snowflake.warehouse", "")
+	viper.GetViper().SetDefault("dump.snowflake.database", "")
+	viper.GetViper().SetDefault("dump.snowflake.schema", "")
+	viper.GetViper().SetDefault("dump.snowflake.stage", "")
+	viper.GetViper().SetDefault("dump.snowflake.table", "")
+	viper.GetViper().SetDefault("dump.snowflake.private_key_file", "")
+	viper.GetViper().SetDefault("dump.s3.bucket", "")
+	viper.GetViper().SetDefault("dump.s3.prefix", "")
+	viper.GetViper().SetDefault("dump.s3.region", "")
+
+	viper.GetViper().SetDefault("shutdown.drain_timeout", 120)
+	viper.GetViper().SetDefault("shutdown.drain_poll_interval", 2)
+	viper.GetViper().SetDefault("shutdown.pause_retries", 3)
+	viper.GetViper().SetDefault("shutdown.max_drain_lifetime", 300)
+	viper.GetViper().SetDefault("shutdown.phase_webhook_url", "")
+	viper.GetViper().SetDefault("shutdown.verify_stopped", false)
+	viper.GetViper().SetDefault("shutdown.verify_stopped_timeout", 30)
+	viper.GetViper().SetDefault("shutdown.drain_conditions", []string{"connections"})
+	viper.GetViper().SetDefault("shutdown.proceed_file", "")
+	viper.GetViper().SetDefault("shutdown.command", "kill")
+
+	viper.GetViper().SetDefault("debug.runtime_stats_interval", 0)
+
+	viper.GetViper().SetDefault("notifications.webhook_url", "")
+	viper.GetViper().SetDefault("notifications.alert_webhook_url", "")
+	viper.GetViper().SetDefault("notifications.timeout", 5)
+
+	viper.GetViper().SetDefault("tracing.enabled", false)
+	viper.GetViper().SetDefault("tracing.endpoint", "")
+	viper.GetViper().SetDefault("tracing.sample_rate", 1.0)
 
 	if file := os.Getenv("AGENT_CONFIG_FILE"); file != "" {
 		// if the config file path is specified in the env, load that
 		viper.SetConfigFile(file)
-	} else {
-		// otherwise setup some default locations
-		viper.SetConfigName("config")
-		viper.SetConfigType("yaml")
-		viper.AddConfigPath("/etc/proxysql-agent")
-		viper.AddConfigPath(".")
+		viper.SetConfigType(configType(file))
+	} else if file := findConfigFile([]string{"/etc/proxysql-agent", "."}); file != "" {
+		// otherwise look in some default locations
+		viper.SetConfigFile(file)
+		viper.SetConfigType(configType(file))
 	}
 
 	// read the config file, if it exists. if not, keep on truckin'
@@ -96,19 +310,107 @@ func Configure() (*Config, error) {
 	pflag.Int("start_delay", 0, "seconds to pause before starting agent")
 	pflag.String("log.level", "INFO", "the log level for the agent; defaults to INFO")
 	pflag.String("log.format", "JSON", "Format of the logs; valid values: [JSON OR plain]")
+	pflag.String("log.output", "stdout", "where to write logs; valid values: [stdout OR stderr OR a file path]")
+	pflag.Bool("log.effective_config", false, "log the merged configuration as JSON at startup, with the password redacted")
+	pflag.Bool("log.probes", false, "log every row of the server tables when SIGUSR1 is received, not just the row counts")
+	pflag.Int("log.max_size_mb", 100, "size in MB a log file can reach before it's rotated; only used when log.output is a file")
+	pflag.Int("log.max_backups", 3, "number of rotated log files to keep; 0 keeps them all")
+	pflag.Int("log.max_age_days", 28, "days to keep rotated log files for; 0 keeps them forever")
 	pflag.String("run_mode", "", "mode to run the agent in; valid values: [core OR satellite]")
 
 	pflag.String("proxysql.address", "127.0.0.1:6032", "proxysql admin interface address")
 	pflag.String("proxysql.username", "radmin", "user for the proxysql admin interface")
-	pflag.String("proxysql.password", "radmin", "password for the proxysql admin interface; this is not recommended for use in production")
+	pflag.String("proxysql.password", "", "password for the proxysql admin interface; this is not recommended for use in production")
+	pflag.String("proxysql.password_file", "", "file to read the proxysql admin password from; overrides proxysql.password")
+	pflag.Int("proxysql.password_reload_interval", 0, "seconds between checks of proxysql.password_file for a new password; 0 disables it")
+	pflag.Int("proxysql.keepalive_interval", 0, "seconds between pings of the admin interface, to keep the pooled connections alive; 0 disables it")
+	pflag.Int("proxysql.admin_port", 0, "port the agent connects to the admin interface on; overrides the port in proxysql.address")
+	pflag.Int("proxysql.cluster_port", 0, "port written to proxysql_servers for core pods; defaults to the admin port")
+	pflag.String("proxysql.connection_tag", "proxysql-agent", "program_name connection attribute sent to the admin interface; disabled if empty")
+	pflag.Int("proxysql.max_open_conns", 0, "maximum connections to the admin interface; 0 is unlimited")
+	pflag.Int("proxysql.max_idle_conns", 2, "idle connections to the admin interface kept in the pool")
+	pflag.Int("proxysql.conn_max_lifetime", 0, "seconds a connection to the admin interface is reused for; 0 reuses them forever")
+	pflag.Int("proxysql.connect_timeout", 30, "seconds to keep retrying the first connection to the admin interface for; 0 tries once")
+	pflag.Bool("proxysql.tls.enabled", false, "connect to the admin interface over TLS")
+	pflag.String("proxysql.tls.ca_file", "", "CA bundle to verify the admin interface's certificate with; the system roots are used if empty")
+	pflag.String("proxysql.tls.cert_file", "", "client certificate for the admin interface; requires proxysql.tls.key_file")
+	pflag.String("proxysql.tls.key_file", "", "client key for the admin interface; requires proxysql.tls.cert_file")
+	pflag.Bool("proxysql.tls.skip_verify", false, "don't verify the admin interface's certificate; this is not recommended for use in production")
 
 	pflag.Int("core.interval", 10, "seconds to sleep in the core clustering loop")
+	pflag.Int("core.informer_resync", 30, "seconds between full resyncs of the pod informer; lower values add load on the API server, 0 disables them")
 	pflag.String("core.checksum_file", "/tmp/pods-cs.txt", "path to the pods checksum file")
 	pflag.String("core.podselector.namespace", "proxysql", "namespace to use in the k8s pod selector label")
 	pflag.String("core.podselector.app", "proxysql", "app to use in the k8s pod selector label")
 	pflag.String("core.podselector.component", "core", "component to use in the k8s pod selector label")
+	pflag.StringSlice("core.pod_allowlist", []string{}, "pod name patterns or CIDRs that may be added to the cluster; empty allows all pods")
 
 	pflag.Int("satellite.interval", 10, "seconds to sleep in the satellite clustering loop")
+	pflag.Int("satellite.last_check_ms", 30000, "milliseconds since the last check before a core pod is considered missing")
+	pflag.String("satellite.core_hostname", "proxysql-core", "hostname of the core service entry in proxysql_servers, which isn't counted as a core pod")
+
+	pflag.String("kube.config_path", "", "kubeconfig to talk to k8s with, for running outside of the cluster; defaults to $KUBECONFIG, then the in-cluster config")
+
+	pflag.Bool("api.metrics_enabled", true, "serve prometheus metrics on /metrics")
+	pflag.String("api.tls.cert_file", "", "certificate to serve the HTTP API over TLS with; requires api.tls.key_file")
+	pflag.String("api.tls.key_file", "", "key to serve the HTTP API over TLS with; requires api.tls.cert_file")
+	pflag.String("api.auth_token", "", "require this bearer token on the HTTP API; disabled if empty")
+	pflag.Bool("api.auth_exempt_health", true, "don't require api.auth_token on the /healthz endpoints")
+	pflag.Bool("api.pprof_enabled", false, "serve the pprof profiles on /debug/pprof/")
+	pflag.Int("api.probe_cache_ms", 1000, "milliseconds to reuse a probe result for, to cut the queries from rapid probes; 0 disables it")
+	pflag.Int("api.probe_timeout", 2, "seconds each probe query can take before the probe fails; 0 disables it")
+
+	pflag.Bool("readiness.require_core_visible", false, "satellites report not ready when no core pods are visible")
+	pflag.Bool("readiness.check_monitor", false, "report not ready when the proxysql monitor can't reach any backends")
+	pflag.Int("readiness.max_lag_ms", 0, "report not ready when every online backend's replication lag is above this; 0 disables the check")
+
+	pflag.Bool("probes.log_proxysql_errors", false, "log recent backend errors from stats_mysql_errors when the probes find proxysql unhealthy")
+
+	pflag.Bool("dump.include_conn_pool", false, "also dump stats_mysql_connection_pool in dump mode")
+	pflag.String("dump.expect_component", "", "refuse to dump unless the pod's component label matches this; disabled if empty")
+	pflag.String("dump.time_format", "rfc3339", "format for timestamps in dump files; valid values: [unix OR rfc3339 OR a Go time layout]")
+	pflag.Bool("dump.include_client_address", false, "include the client_address column in the query digests dump")
+	pflag.StringSlice("dump.tables", []string{"query_digest", "query_rules", "query_rule_stats"}, "what to dump to CSV; query_digest, query_rules, query_rule_stats, or the name of any other admin or stats table")
+	pflag.String("dump.output_dir", "/tmp", "directory to write dump files to, in a new subdirectory per run; created if it doesn't exist")
+	pflag.Bool("dump.compress", false, "gzip the dump files, which are then named *.csv.gz")
+	pflag.Int("dump.interval", 0, "seconds between dumps in dump mode; 0 dumps once and exits")
+	pflag.Bool("dump.leader_election", false, "elect a leader with a k8s lease, so that only one dump mode agent dumps at a time")
+	pflag.String("dump.lease_name", "proxysql-agent-dump", "name of the k8s lease used for dump.leader_election")
+	pflag.Bool("core.leader_election", false, "old name of dump.leader_election")
+	pflag.String("core.lease_name", "proxysql-agent-dump", "old name of dump.lease_name")
+	pflag.Bool("dump.reset.digests", false, "reset the query digests after dumping them, by reading stats_mysql_query_digest_reset")
+	pflag.String("dump.snowflake.account", "", "snowflake account to upload the query digests dump to; uploads are disabled if empty")
+	pflag.String("dump.snowflake.user", "", "snowflake user to upload as")
+	pflag.String("dump.snowflake.warehouse", "", "snowflake warehouse to run the COPY INTO with")
+	pflag.String("dump.snowflake.database", "", "snowflake database containing the stage and table")
+	pflag.String("dump.snowflake.schema", "", "snowflake schema containing the stage and table")
+	pflag.String("dump.snowflake.stage", "", "snowflake stage to PUT the query digests dump to")
+	pflag.String("dump.snowflake.table", "", "snowflake table to COPY the query digests into")
+	pflag.String("dump.snowflake.private_key_file", "", "PKCS8 PEM private key for snowflake key pair authentication")
+	pflag.String("dump.s3.bucket", "", "S3 bucket to upload the dump files to; uploads are disabled if empty")
+	pflag.String("dump.s3.prefix", "", "prefix for the dump files' keys in the S3 bucket")
+	pflag.String("dump.s3.region", "", "region of the S3 bucket; the AWS SDK's default region is used if empty")
+
+	pflag.Int("shutdown.drain_timeout", 120, "seconds to wait for clients to drain before shutting down proxysql; 0 waits forever")
+	pflag.Int("shutdown.drain_poll_interval", 2, "seconds between checks of shutdown.drain_conditions while draining")
+	pflag.Int("shutdown.pause_retries", 3, "times to retry PROXYSQL PAUSE if it fails while draining")
+	pflag.Int("shutdown.max_drain_lifetime", 300, "hard limit in seconds on how long the pod can stay draining; 0 disables it")
+	pflag.String("shutdown.phase_webhook_url", "", "URL to POST shutdown phase changes to; disabled if empty")
+	pflag.Bool("shutdown.verify_stopped", false, "after killing proxysql, check that the admin port stops accepting connections")
+	pflag.Int("shutdown.verify_stopped_timeout", 30, "seconds to wait for the admin port to close when shutdown.verify_stopped is set")
+	pflag.StringSlice("shutdown.drain_conditions", []string{"connections"}, "conditions that end the drain, whichever is met first; valid values: [connections, transactions, proceed_file]")
+	pflag.String("shutdown.proceed_file", "", "file whose appearance ends the drain, when proceed_file is in shutdown.drain_conditions")
+	pflag.String("shutdown.command", "kill", "how proxysql is stopped once drained; valid values: [kill, slow, fast]")
+
+	pflag.Int("debug.runtime_stats_interval", 0, "seconds between DEBUG logs of the agent's goroutine, heap and GC stats; 0 disables them")
+
+	pflag.String("notifications.webhook_url", "", "URL to POST an event to when a pod joins or leaves the cluster; disabled if empty")
+	pflag.String("notifications.alert_webhook_url", "", "URL to POST an alert to when every backend goes offline, and when they recover; disabled if empty")
+	pflag.Int("notifications.timeout", 5, "seconds to wait for the notification webhooks to respond")
+
+	pflag.Bool("tracing.enabled", false, "export OpenTelemetry traces of the probes and cluster changes")
+	pflag.String("tracing.endpoint", "", "OTLP/HTTP endpoint to export traces to, eg: http://otel-collector:4318")
+	pflag.Float64("tracing.sample_rate", 1.0, "fraction of traces to sample, between 0 and 1")
 
 	pflag.Bool("show-config", false, "Dump the configuration for debugging")
 
@@ -117,6 +419,13 @@ func Configure() (*Config, error) {
 		return nil, err
 	}
 
+	for _, setting := range renamedSettings {
+		err := pflag.CommandLine.MarkDeprecated(setting.old, "use --"+setting.key+" instead")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	pflag.Parse()
 
 	err = viper.BindPFlags(pflag.CommandLine)
@@ -130,32 +439,454 @@ func Configure() (*Config, error) {
 		fmt.Println("settings", viper.GetViper().AllSettings())
 	}
 
+	applyRenamedSettings()
+
 	// run some validations before proceeding
+	if err := validateConfig(); err != nil {
+		return nil, err
+	}
+
+	settings := &Config{}
+
+	err = viper.Unmarshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// the password file is typically a mounted k8s secret, which keeps the password out of the config and env
+	if file := settings.ProxySQL.PasswordFile; file != "" {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read proxysql.password_file: %w", err)
+		}
+
+		settings.ProxySQL.Password = strings.TrimSpace(string(contents))
+	}
+
+	return settings, nil
+}
+
+// Settings that have been renamed. The old names still work, so that existing configs keep working, but the new
+// name wins if both are set.
+//
+//nolint:gochecknoglobals
+var renamedSettings = []struct {
+	old          string
+	key          string
+	defaultValue string
+}{
+	// the leader election only ever gated the dumps, so it moved to the dump settings
+	{old: "core.leader_election", key: "dump.leader_election", defaultValue: "false"},
+	{old: "core.lease_name", key: "dump.lease_name", defaultValue: "proxysql-agent-dump"},
+}
+
+// Copy the settings that are set under their old names over to the new ones, unless the new one has been set too.
+func applyRenamedSettings() {
+	for _, setting := range renamedSettings {
+		if !viper.GetViper().IsSet(setting.old) || viper.GetViper().GetString(setting.key) != setting.defaultValue {
+			continue
+		}
+
+		viper.GetViper().Set(setting.key, viper.GetViper().Get(setting.old))
+	}
+}
+
+// The config file formats that are supported, in the order they're searched for.
+var configExtensions = []string{"yaml", "yml", "toml", "json"} //nolint:gochecknoglobals
+
+// Work out the format of a config file from its extension. Files without a recognised extension (eg: a
+// mounted configmap key) are assumed to be yaml, as they always have been.
+func configType(file string) string {
+	ext := strings.TrimPrefix(filepath.Ext(file), ".")
+
+	if slices.Contains(configExtensions, ext) {
+		return ext
+	}
+
+	return "yaml"
+}
+
+// Look for a config file named config.<ext> in each of the directories, trying the formats in order. Returns
+// an empty string if there isn't one.
+func findConfigFile(dirs []string) string {
+	for _, dir := range dirs {
+		for _, ext := range configExtensions {
+			file := filepath.Join(dir, "config."+ext)
+
+			if info, err := os.Stat(file); err == nil && !info.IsDir() {
+				return file
+			}
+		}
+	}
+
+	return ""
+}
+
+// Check the settings, and return every problem found rather than just the first, so that a new config
+// can be fixed in one pass.
+func validateConfig() error {
+	var errs []error
+
 	if viper.GetViper().IsSet("run_mode") {
 		runMode := viper.GetViper().GetString("run_mode")
 		if runMode != "core" && runMode != "satellite" && runMode != "dump" {
-			return nil, errors.New("run_mode must be either 'core' or 'satellite'")
+			errs = append(errs, errors.New("run_mode must be either 'core' or 'satellite'"))
 		}
 	}
 
 	if delay := viper.GetViper().GetInt("start_delay"); delay < 0 {
-		return nil, errors.New("start_delay cannot be < 0")
+		errs = append(errs, errors.New("start_delay cannot be < 0"))
+	}
+
+	for _, key := range []string{"log.max_size_mb", "log.max_backups", "log.max_age_days"} {
+		if viper.GetViper().GetInt(key) < 0 {
+			errs = append(errs, fmt.Errorf("%s cannot be < 0", key))
+		}
 	}
 
 	if cinterval := viper.GetViper().GetInt("core.interval"); cinterval < 0 {
-		return nil, errors.New("core.interval cannot be < 0")
+		errs = append(errs, errors.New("core.interval cannot be < 0"))
 	}
 
-	if sinterval := viper.GetViper().GetInt("satellite.interval"); sinterval < 0 {
-		return nil, errors.New("satellite.interval cannot be < 0")
+	if resync := viper.GetViper().GetInt("core.informer_resync"); resync < 0 {
+		errs = append(errs, errors.New("core.informer_resync cannot be < 0"))
 	}
 
-	settings := &Config{}
+	if port := viper.GetViper().GetInt("proxysql.admin_port"); port < 0 || port > 65535 {
+		errs = append(errs, errors.New("proxysql.admin_port must be between 0 and 65535"))
+	}
 
-	err = viper.Unmarshal(settings)
+	if port := viper.GetViper().GetInt("proxysql.cluster_port"); port < 0 || port > 65535 {
+		errs = append(errs, errors.New("proxysql.cluster_port must be between 0 and 65535"))
+	}
+
+	// the driver sends connection attributes as a comma separated list of key:value pairs
+	if tag := viper.GetViper().GetString("proxysql.connection_tag"); strings.ContainsAny(tag, ",:") {
+		errs = append(errs, errors.New("proxysql.connection_tag cannot contain ',' or ':'"))
+	}
+
+	if viper.GetViper().GetBool("proxysql.tls.enabled") {
+		errs = append(errs, validateTLSFiles()...)
+	}
+
+	for _, key := range []string{"proxysql.max_open_conns", "proxysql.max_idle_conns", "proxysql.conn_max_lifetime", "proxysql.connect_timeout"} {
+		if viper.GetViper().GetInt(key) < 0 {
+			errs = append(errs, fmt.Errorf("%s cannot be < 0", key))
+		}
+	}
+
+	if open := viper.GetViper().GetInt("proxysql.max_open_conns"); open > 0 && viper.GetViper().GetInt("proxysql.max_idle_conns") > open {
+		errs = append(errs, errors.New("proxysql.max_idle_conns cannot be > proxysql.max_open_conns"))
+	}
+
+	if interval := viper.GetViper().GetInt("proxysql.password_reload_interval"); interval < 0 {
+		errs = append(errs, errors.New("proxysql.password_reload_interval cannot be < 0"))
+	}
+
+	if interval := viper.GetViper().GetInt("proxysql.keepalive_interval"); interval < 0 {
+		errs = append(errs, errors.New("proxysql.keepalive_interval cannot be < 0"))
+	}
+
+	// the address only needs a port if proxysql.admin_port doesn't supply one
+	if viper.GetViper().GetInt("proxysql.admin_port") == 0 {
+		if _, _, err := net.SplitHostPort(viper.GetViper().GetString("proxysql.address")); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %w", ErrMissingPort, err))
+		}
+	}
+
+	if err := validateStringList("proxysql.startup_commands"); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, entry := range viper.GetViper().GetStringSlice("core.pod_allowlist") {
+		if err := validateAllowlistEntry(entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := validateStringList("dump.tables"); err != nil {
+		errs = append(errs, err)
+	}
+
+	// the dump.tables entries aren't checked here, as an unknown table is skipped with a warning when dumping
+
+	if dinterval := viper.GetViper().GetInt("dump.interval"); dinterval < 0 {
+		errs = append(errs, errors.New("dump.interval cannot be < 0"))
+	}
+
+	if viper.GetViper().GetString("dump.output_dir") == "" {
+		errs = append(errs, errors.New("dump.output_dir cannot be empty"))
+	}
+
+	if viper.GetViper().GetString("dump.snowflake.account") != "" {
+		errs = append(errs, validateSnowflake()...)
+	}
+
+	if cache := viper.GetViper().GetInt("api.probe_cache_ms"); cache < 0 {
+		errs = append(errs, errors.New("api.probe_cache_ms cannot be < 0"))
+	}
+
+	if timeout := viper.GetViper().GetInt("api.probe_timeout"); timeout < 0 {
+		errs = append(errs, errors.New("api.probe_timeout cannot be < 0"))
+	}
+
+	if lag := viper.GetViper().GetInt("readiness.max_lag_ms"); lag < 0 {
+		errs = append(errs, errors.New("readiness.max_lag_ms cannot be < 0"))
+	}
+
+	// the satellite loop ticks every interval, so it can't be 0
+	if sinterval := viper.GetViper().GetInt("satellite.interval"); sinterval <= 0 {
+		errs = append(errs, errors.New("satellite.interval must be > 0"))
+	}
+
+	if lastCheck := viper.GetViper().GetInt("satellite.last_check_ms"); lastCheck <= 0 {
+		errs = append(errs, errors.New("satellite.last_check_ms must be > 0"))
+	}
+
+	if timeout := viper.GetViper().GetInt("shutdown.drain_timeout"); timeout < 0 {
+		errs = append(errs, errors.New("shutdown.drain_timeout cannot be < 0"))
+	}
+
+	// a poll interval as long as the drain timeout would only check the conditions once
+	if interval := viper.GetViper().GetInt("shutdown.drain_poll_interval"); interval <= 0 {
+		errs = append(errs, errors.New("shutdown.drain_poll_interval must be > 0"))
+	} else if timeout := viper.GetViper().GetInt("shutdown.drain_timeout"); timeout > 0 && interval >= timeout {
+		errs = append(errs, errors.New("shutdown.drain_poll_interval must be < shutdown.drain_timeout"))
+	}
+
+	if retries := viper.GetViper().GetInt("shutdown.pause_retries"); retries < 0 {
+		errs = append(errs, errors.New("shutdown.pause_retries cannot be < 0"))
+	}
+
+	if lifetime := viper.GetViper().GetInt("shutdown.max_drain_lifetime"); lifetime < 0 {
+		errs = append(errs, errors.New("shutdown.max_drain_lifetime cannot be < 0"))
+	}
+
+	if timeout := viper.GetViper().GetInt("shutdown.verify_stopped_timeout"); timeout < 0 {
+		errs = append(errs, errors.New("shutdown.verify_stopped_timeout cannot be < 0"))
+	}
+
+	if err := validateStringList("shutdown.drain_conditions"); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, condition := range viper.GetViper().GetStringSlice("shutdown.drain_conditions") {
+		switch condition {
+		case "connections", "transactions":
+		case "proceed_file":
+			if viper.GetViper().GetString("shutdown.proceed_file") == "" {
+				errs = append(errs, errors.New("shutdown.proceed_file must be set to use the proceed_file drain condition"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("shutdown.drain_conditions entry %q must be one of connections, transactions or proceed_file", condition))
+		}
+	}
+
+	switch command := viper.GetViper().GetString("shutdown.command"); command {
+	case "kill", "slow", "fast":
+	default:
+		errs = append(errs, fmt.Errorf("shutdown.command %q must be one of kill, slow or fast", command))
+	}
+
+	if interval := viper.GetViper().GetInt("debug.runtime_stats_interval"); interval < 0 {
+		errs = append(errs, errors.New("debug.runtime_stats_interval cannot be < 0"))
+	}
+
+	if timeout := viper.GetViper().GetInt("notifications.timeout"); timeout <= 0 {
+		errs = append(errs, errors.New("notifications.timeout must be > 0"))
+	}
+
+	if viper.GetViper().GetBool("dump.leader_election") && viper.GetViper().GetString("dump.lease_name") == "" {
+		errs = append(errs, errors.New("dump.lease_name cannot be empty when dump.leader_election is set"))
+	}
+
+	if viper.GetViper().GetBool("tracing.enabled") && viper.GetViper().GetString("tracing.endpoint") == "" {
+		errs = append(errs, errors.New("tracing.endpoint cannot be empty when tracing.enabled is set"))
+	}
+
+	if rate := viper.GetViper().GetFloat64("tracing.sample_rate"); rate < 0 || rate > 1 {
+		errs = append(errs, errors.New("tracing.sample_rate must be between 0 and 1"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// EffectiveJSON renders the fully resolved configuration as JSON, keyed the same way as the config file, so that
+// precedence problems between the file, ENV and flags can be debugged. The admin password, the API token and
+// the webhook URLs are redacted; webhook URLs usually have a token in them, eg: Slack's.
+func (c *Config) EffectiveJSON() (string, error) {
+	redacted := *c
+
+	for _, secret := range []*string{
+		&redacted.ProxySQL.Password,
+		&redacted.API.AuthToken,
+		&redacted.Notifications.WebhookURL,
+		&redacted.Notifications.AlertWebhookURL,
+		&redacted.Shutdown.PhaseWebhookURL,
+	} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+
+	var settings map[string]any
+
+	if err := mapstructure.Decode(redacted, &settings); err != nil {
+		return "", err
+	}
+
+	out, err := json.Marshal(settings)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return settings, nil
+	return string(out), nil
+}
+
+// AdminPort is the port of the proxysql admin interface that the agent connects to; proxysql.admin_port if
+// it's set, otherwise the port in proxysql.address.
+func (c *Config) AdminPort() (int, error) {
+	if c.ProxySQL.AdminPort > 0 {
+		return c.ProxySQL.AdminPort, nil
+	}
+
+	// SplitHostPort handles bracketed IPv6 addresses, eg: [fd00::1]:6032
+	_, port, err := net.SplitHostPort(c.ProxySQL.Address)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrMissingPort, err)
+	}
+
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrMissingPort, err)
+	}
+
+	return number, nil
+}
+
+// AdminAddress is the host:port the agent connects to the admin interface on.
+func (c *Config) AdminAddress() (string, error) {
+	port, err := c.AdminPort()
+	if err != nil {
+		return "", err
+	}
+
+	host, _, err := net.SplitHostPort(c.ProxySQL.Address)
+	if err != nil {
+		// proxysql.admin_port is set and the address is just a host
+		host = c.ProxySQL.Address
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// ClusterPort is the port that core pods are registered with in proxysql_servers. This is usually the same as
+// the admin port, but some deployments use a different port for cluster communication; set proxysql.cluster_port
+// to override it.
+func (c *Config) ClusterPort() (int, error) {
+	if c.ProxySQL.ClusterPort > 0 {
+		return c.ProxySQL.ClusterPort, nil
+	}
+
+	return c.AdminPort()
+}
+
+// Table names in dump.tables end up in a SELECT, so they're limited to what proxysql's own tables look like,
+// optionally qualified with a schema (eg: monitor.mysql_server_ping_log).
+var tableNamePattern = regexp.MustCompile(`^([a-z_][a-z0-9_]*\.)?[a-z_][a-z0-9_]*$`) //nolint:gochecknoglobals
+
+// ValidTableName reports whether the name is safe to use as a table in a query.
+func ValidTableName(table string) bool {
+	return tableNamePattern.MatchString(table)
+}
+
+// The stage and table in dump.snowflake end up in the PUT and COPY INTO statements, so they're limited to plain
+// identifiers; the table can be qualified with a database and schema.
+var snowflakeIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*){0,2}$`) //nolint:gochecknoglobals
+
+// Every dump.snowflake key has to be set once the account is, and the key file is read when the upload runs, so
+// check it up front rather than failing after the dump.
+func validateSnowflake() []error {
+	var errs []error
+
+	for _, key := range []string{"user", "warehouse", "database", "schema", "stage", "table", "private_key_file"} {
+		if viper.GetViper().GetString("dump.snowflake."+key) == "" {
+			errs = append(errs, fmt.Errorf("dump.snowflake.%s must be set when dump.snowflake.account is", key))
+		}
+	}
+
+	for _, key := range []string{"stage", "table"} {
+		value := viper.GetViper().GetString("dump.snowflake." + key)
+		if value != "" && !snowflakeIdentifierPattern.MatchString(value) {
+			errs = append(errs, fmt.Errorf("dump.snowflake.%s %q is not a valid identifier", key, value))
+		}
+	}
+
+	if file := viper.GetViper().GetString("dump.snowflake.private_key_file"); file != "" {
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("dump.snowflake.private_key_file: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// The files in proxysql.tls are read when the agent connects, so check them up front rather than failing then.
+func validateTLSFiles() []error {
+	var errs []error
+
+	certFile := viper.GetViper().GetString("proxysql.tls.cert_file")
+	keyFile := viper.GetViper().GetString("proxysql.tls.key_file")
+
+	if (certFile == "") != (keyFile == "") {
+		errs = append(errs, fmt.Errorf("%w: proxysql.tls.cert_file and proxysql.tls.key_file must be set together", ErrInvalidTLSConfig))
+	}
+
+	for _, key := range []string{"proxysql.tls.ca_file", "proxysql.tls.cert_file", "proxysql.tls.key_file"} {
+		file := viper.GetViper().GetString(key)
+		if file == "" {
+			continue
+		}
+
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrInvalidTLSConfig, key, err))
+		}
+	}
+
+	return errs
+}
+
+// Entries in core.pod_allowlist are either CIDRs (anything containing a /) or pod name patterns.
+func validateAllowlistEntry(entry string) error {
+	if strings.Contains(entry, "/") {
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("core.pod_allowlist entry %q is not a valid CIDR: %w", entry, err)
+		}
+
+		return nil
+	}
+
+	if _, err := path.Match(entry, ""); err != nil {
+		return fmt.Errorf("core.pod_allowlist entry %q is not a valid pattern: %w", entry, err)
+	}
+
+	return nil
+}
+
+// Viper will happily coerce a scalar into a list, so check that the key really is a list of strings.
+func validateStringList(key string) error {
+	switch value := viper.GetViper().Get(key).(type) {
+	case nil, []string:
+		return nil
+	case []any:
+		for _, item := range value {
+			if _, ok := item.(string); !ok {
+				return fmt.Errorf("%s must be a list of strings", key)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%s must be a list of strings", key)
+	}
 }
@@ -1,8 +1,10 @@
 package configuration
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/spf13/pflag"
@@ -21,6 +23,9 @@ proxysql:
   address: "proxysql.vip:6032"
   username: "agent-user"
   password: "agent-password"
+  startup_commands:
+    - "UPDATE global_variables SET variable_value = 'true' WHERE variable_name = 'admin-web_enabled'"
+    - "LOAD ADMIN VARIABLES TO RUNTIME"
 core:
   interval: 30
   podselector:
@@ -31,6 +36,38 @@ satellite:
   interval: 60
 `)
 
+// the same settings as testConfigFile
+//
+//nolint:gochecknoglobals
+var testConfigFileTOML = []byte(`
+start_delay = 30
+run_mode = "core"
+
+[log]
+level = "TRACE"
+format = "text"
+
+[proxysql]
+address = "proxysql.vip:6032"
+username = "agent-user"
+password = "agent-password"
+startup_commands = [
+  "UPDATE global_variables SET variable_value = 'true' WHERE variable_name = 'admin-web_enabled'",
+  "LOAD ADMIN VARIABLES TO RUNTIME",
+]
+
+[core]
+interval = 30
+
+[core.podselector]
+namespace = "test-namespace"
+app = "test-application"
+component = "test-component"
+
+[satellite]
+interval = 60
+`)
+
 func TestValidations(t *testing.T) {
 	os.Args = []string{"cmd"}
 
@@ -60,6 +97,17 @@ func TestValidations(t *testing.T) {
 		assert.EqualError(t, err, "run_mode must be either 'core' or 'satellite'")
 	})
 
+	t.Run("reports every problem at once", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--start_delay=-1", "--core.interval=-1", "--shutdown.drain_timeout=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "start_delay cannot be < 0\ncore.interval cannot be < 0\nshutdown.drain_timeout cannot be < 0")
+	})
+
 	t.Run("validate start_delay", func(t *testing.T) {
 		viper.Reset()
 
@@ -71,6 +119,39 @@ func TestValidations(t *testing.T) {
 		assert.EqualError(t, err, "start_delay cannot be < 0")
 	})
 
+	t.Run("validate log.max_size_mb", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--log.max_size_mb=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "log.max_size_mb cannot be < 0")
+	})
+
+	t.Run("validate dump.interval", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--dump.interval=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "dump.interval cannot be < 0")
+	})
+
+	t.Run("validate dump.output_dir", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--dump.output_dir="}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "dump.output_dir cannot be empty")
+	})
+
 	t.Run("validate core.interval", func(t *testing.T) {
 		viper.Reset()
 
@@ -82,6 +163,66 @@ func TestValidations(t *testing.T) {
 		assert.EqualError(t, err, "core.interval cannot be < 0")
 	})
 
+	t.Run("validate api.probe_cache_ms", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--api.probe_cache_ms=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "api.probe_cache_ms cannot be < 0")
+	})
+
+	t.Run("validate readiness.max_lag_ms", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--readiness.max_lag_ms=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "readiness.max_lag_ms cannot be < 0")
+	})
+
+	t.Run("validate core.informer_resync", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--core.informer_resync=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "core.informer_resync cannot be < 0")
+	})
+
+	t.Run("validate satellite.last_check_ms", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--satellite.last_check_ms=0"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "satellite.last_check_ms must be > 0")
+	})
+
+	t.Run("validate notifications.timeout", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--notifications.timeout=0"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "notifications.timeout must be > 0")
+	})
+
+	t.Run("validate tracing", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--tracing.enabled", "--tracing.sample_rate=1.5"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "tracing.endpoint cannot be empty when tracing.enabled is set\ntracing.sample_rate must be between 0 and 1")
+	})
+
 	t.Run("validate satellite.interval", func(t *testing.T) {
 		viper.Reset()
 
@@ -90,7 +231,228 @@ func TestValidations(t *testing.T) {
 
 		_, err := Configure()
 		fmt.Println(err)
-		assert.EqualError(t, err, "satellite.interval cannot be < 0")
+		assert.EqualError(t, err, "satellite.interval must be > 0")
+
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--satellite.interval=0"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err = Configure()
+		assert.EqualError(t, err, "satellite.interval must be > 0")
+	})
+
+	t.Run("validate core.pod_allowlist", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--core.pod_allowlist=proxysql-core-*,10.0.0.0/33"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.ErrorContains(t, err, `core.pod_allowlist entry "10.0.0.0/33" is not a valid CIDR`)
+	})
+
+	t.Run("validate proxysql.keepalive_interval", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.keepalive_interval=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "proxysql.keepalive_interval cannot be < 0")
+	})
+
+	t.Run("validate shutdown.drain_poll_interval", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--shutdown.drain_poll_interval=0"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "shutdown.drain_poll_interval must be > 0")
+
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--shutdown.drain_timeout=10", "--shutdown.drain_poll_interval=10"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err = Configure()
+		assert.EqualError(t, err, "shutdown.drain_poll_interval must be < shutdown.drain_timeout")
+
+		viper.Reset()
+
+		// without a drain timeout there's nothing for the interval to be shorter than
+		os.Args = []string{"cmd", "--shutdown.drain_timeout=0", "--shutdown.drain_poll_interval=30"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err = Configure()
+		assert.NoError(t, err)
+	})
+
+	t.Run("validate shutdown.command", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--shutdown.command=halt"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, `shutdown.command "halt" must be one of kill, slow or fast`)
+	})
+
+	t.Run("validate dump.lease_name", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--dump.leader_election", "--dump.lease_name="}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "dump.lease_name cannot be empty when dump.leader_election is set")
+	})
+
+	t.Run("validate core.lease_name", func(t *testing.T) {
+		viper.Reset()
+
+		// the old name of dump.lease_name is validated as the new one
+		os.Args = []string{"cmd", "--core.leader_election", "--core.lease_name="}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.EqualError(t, err, "dump.lease_name cannot be empty when dump.leader_election is set")
+	})
+
+	t.Run("validate dump.tables", func(t *testing.T) {
+		viper.Reset()
+
+		// unknown tables are skipped with a warning when dumping, rather than stopping the agent from starting
+		os.Args = []string{"cmd", "--dump.tables=stats_mysql_global,monitor.mysql_server_ping_log,stats_mysql_global; DROP"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		assert.NoError(t, err)
+	})
+
+	t.Run("validate dump.snowflake", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{
+			"cmd",
+			"--dump.snowflake.account=myorg-myaccount",
+			"--dump.snowflake.user=proxysql",
+			"--dump.snowflake.warehouse=loading",
+			"--dump.snowflake.database=analytics",
+			"--dump.snowflake.schema=proxysql",
+			"--dump.snowflake.stage=digests; DROP TABLE x",
+			"--dump.snowflake.table=query_digests",
+		}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "dump.snowflake.private_key_file must be set when dump.snowflake.account is\n"+
+			`dump.snowflake.stage "digests; DROP TABLE x" is not a valid identifier`)
+	})
+
+	t.Run("validate proxysql.startup_commands", func(t *testing.T) {
+		tmpfile, err := os.CreateTemp("", "config_test_*.yaml")
+		assert.NoError(t, err)
+
+		t.Cleanup(func() {
+			os.Remove(tmpfile.Name())
+		})
+
+		_, err = tmpfile.WriteString("proxysql:\n  startup_commands:\n    - 1\n    - [\"nested\"]\n")
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		t.Setenv("AGENT_CONFIG_FILE", tmpfile.Name())
+
+		viper.Reset()
+
+		os.Args = []string{"cmd"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err = Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "proxysql.startup_commands must be a list of strings")
+	})
+
+	t.Run("validate proxysql.connection_tag", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.connection_tag=agent,extra:attr"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "proxysql.connection_tag cannot contain ',' or ':'")
+	})
+
+	t.Run("validate proxysql.tls", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.tls.enabled", "--proxysql.tls.cert_file=/nonexistent/cert.pem"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.ErrorIs(t, err, ErrInvalidTLSConfig)
+		assert.ErrorContains(t, err, "proxysql.tls.cert_file and proxysql.tls.key_file must be set together")
+		assert.ErrorContains(t, err, "proxysql.tls.cert_file: stat /nonexistent/cert.pem")
+
+		// the files aren't checked unless tls is enabled
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.tls.cert_file=/nonexistent/cert.pem"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err = Configure()
+		assert.NoError(t, err)
+	})
+
+	t.Run("validate proxysql.max_idle_conns", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.max_open_conns=1", "--proxysql.max_idle_conns=2"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "proxysql.max_idle_conns cannot be > proxysql.max_open_conns")
+	})
+
+	t.Run("validate proxysql.address", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--proxysql.address=127.0.0.1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.ErrorIs(t, err, ErrMissingPort)
+	})
+
+	t.Run("validate shutdown.drain_conditions", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--shutdown.drain_conditions=connections,proceed_file,queries"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "shutdown.proceed_file must be set to use the proceed_file drain condition\n"+
+			`shutdown.drain_conditions entry "queries" must be one of connections, transactions or proceed_file`)
+	})
+
+	t.Run("validate shutdown.drain_timeout", func(t *testing.T) {
+		viper.Reset()
+
+		os.Args = []string{"cmd", "--shutdown.drain_timeout=-1"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		_, err := Configure()
+		fmt.Println(err)
+		assert.EqualError(t, err, "shutdown.drain_timeout cannot be < 0")
 	})
 }
 
@@ -104,6 +466,31 @@ func TestDefaults(t *testing.T) {
 
 	assert.NoError(t, err, "Configuration should not return an error")
 	assert.Equal(t, 10, defaultsConfig.Satellite.Interval)
+	assert.Equal(t, 30000, defaultsConfig.Satellite.LastCheckMS)
+	assert.Equal(t, "proxysql-core", defaultsConfig.Satellite.CoreHostname)
+	assert.Equal(t, 30, defaultsConfig.Core.InformerResync)
+	assert.False(t, defaultsConfig.Dump.LeaderElection)
+	assert.Equal(t, "proxysql-agent-dump", defaultsConfig.Dump.LeaseName)
+	assert.Equal(t, 2, defaultsConfig.API.ProbeTimeout)
+	assert.InDelta(t, 1.0, defaultsConfig.Tracing.SampleRate, 0)
+	assert.Equal(t, 120, defaultsConfig.Shutdown.DrainTimeout)
+	assert.Equal(t, 2, defaultsConfig.Shutdown.DrainPollInterval)
+	assert.Equal(t, "kill", defaultsConfig.Shutdown.Command)
+	assert.Equal(t, "proxysql-agent", defaultsConfig.ProxySQL.ConnectionTag)
+	assert.Equal(t, 0, defaultsConfig.ProxySQL.MaxOpenConns)
+	assert.Equal(t, 2, defaultsConfig.ProxySQL.MaxIdleConns)
+	assert.Equal(t, 30, defaultsConfig.ProxySQL.ConnectTimeout)
+	assert.Equal(t, "/tmp", defaultsConfig.Dump.OutputDir)
+	assert.True(t, defaultsConfig.API.MetricsEnabled)
+	assert.True(t, defaultsConfig.API.AuthExemptHealth)
+	assert.Equal(t, 1000, defaultsConfig.API.ProbeCacheMS)
+	assert.Equal(t, []string{"query_digest", "query_rules", "query_rule_stats"}, defaultsConfig.Dump.Tables)
+
+	// the flag's default and viper's default have to agree, otherwise the effective default depends on
+	// whether the flag was registered
+	assert.Equal(t, "", defaultsConfig.ProxySQL.Password)
+	assert.Equal(t, "", pflag.CommandLine.Lookup("proxysql.password").DefValue)
+	assert.Equal(t, pflag.CommandLine.Lookup("proxysql.username").DefValue, defaultsConfig.ProxySQL.Username)
 }
 
 func TestConfigFile(t *testing.T) {
@@ -137,6 +524,10 @@ func TestConfigFile(t *testing.T) {
 	assert.Equal(t, "proxysql.vip:6032", fileConfig.ProxySQL.Address)
 	assert.Equal(t, "agent-user", fileConfig.ProxySQL.Username)
 	assert.Equal(t, "agent-password", fileConfig.ProxySQL.Password)
+	assert.Equal(t, []string{
+		"UPDATE global_variables SET variable_value = 'true' WHERE variable_name = 'admin-web_enabled'",
+		"LOAD ADMIN VARIABLES TO RUNTIME",
+	}, fileConfig.ProxySQL.StartupCommands)
 
 	assert.Equal(t, "test-application", fileConfig.Core.PodSelector.App)
 	assert.Equal(t, "test-component", fileConfig.Core.PodSelector.Component)
@@ -144,6 +535,92 @@ func TestConfigFile(t *testing.T) {
 	assert.Equal(t, 60, fileConfig.Satellite.Interval)
 }
 
+func TestConfigFileFormats(t *testing.T) {
+	load := func(name string, contents []byte) *Config {
+		file := filepath.Join(t.TempDir(), name)
+
+		err := os.WriteFile(file, contents, 0o600)
+		assert.NoError(t, err)
+
+		t.Setenv("AGENT_CONFIG_FILE", file)
+
+		viper.Reset()
+
+		os.Args = []string{"cmd"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		settings, err := Configure()
+		assert.NoError(t, err, "Configuration should not return an error")
+
+		return settings
+	}
+
+	yamlConfig := load("config.yaml", testConfigFile)
+	tomlConfig := load("config.toml", testConfigFileTOML)
+
+	assert.Equal(t, "agent-user", tomlConfig.ProxySQL.Username)
+	assert.Equal(t, yamlConfig, tomlConfig)
+
+	// files without an extension are still read as yaml
+	assert.Equal(t, yamlConfig, load("config", testConfigFile))
+}
+
+func TestRenamedSettings(t *testing.T) {
+	load := func(contents string) *Config {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+
+		err := os.WriteFile(file, []byte(contents), 0o600)
+		assert.NoError(t, err)
+
+		t.Setenv("AGENT_CONFIG_FILE", file)
+
+		viper.Reset()
+
+		os.Args = []string{"cmd"}
+		pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+		settings, err := Configure()
+		assert.NoError(t, err, "Configuration should not return an error")
+
+		return settings
+	}
+
+	t.Run("old names", func(t *testing.T) {
+		settings := load("core:\n  leader_election: true\n  lease_name: proxysql-agent\n")
+
+		assert.True(t, settings.Dump.LeaderElection)
+		assert.Equal(t, "proxysql-agent", settings.Dump.LeaseName)
+	})
+
+	t.Run("new names win", func(t *testing.T) {
+		settings := load("core:\n  lease_name: proxysql-agent\ndump:\n  leader_election: true\n  lease_name: dump-lease\n")
+
+		assert.True(t, settings.Dump.LeaderElection)
+		assert.Equal(t, "dump-lease", settings.Dump.LeaseName)
+	})
+}
+
+func TestFindConfigFile(t *testing.T) {
+	first := t.TempDir()
+	second := t.TempDir()
+
+	assert.Equal(t, "", findConfigFile([]string{first, second}))
+
+	for _, name := range []string{"config.json", "config.toml"} {
+		err := os.WriteFile(filepath.Join(second, name), []byte{}, 0o600)
+		assert.NoError(t, err)
+	}
+
+	// toml is tried before json
+	assert.Equal(t, filepath.Join(second, "config.toml"), findConfigFile([]string{first, second}))
+
+	// and earlier directories win over later ones
+	err := os.WriteFile(filepath.Join(first, "config.json"), []byte{}, 0o600)
+	assert.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(first, "config.json"), findConfigFile([]string{first, second}))
+}
+
 func TestEnvironment(t *testing.T) {
 	t.Setenv("AGENT_START_DELAY", "500")
 	t.Setenv("AGENT_LOG_LEVEL", "env-WARN")
@@ -195,6 +672,7 @@ func TestFlags(t *testing.T) {
 		"--core.interval=1000",
 		"--core.podselector.app=proxysql-green",
 		"--core.podselector.component=notcore",
+		"--core.pod_allowlist=proxysql-core-*,10.0.0.0/8",
 		"--satellite.interval=5533",
 	}
 	pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
@@ -217,6 +695,7 @@ func TestFlags(t *testing.T) {
 	assert.Equal(t, 1000, envConfig.Core.Interval)
 	assert.Equal(t, "proxysql-green", envConfig.Core.PodSelector.App)
 	assert.Equal(t, "notcore", envConfig.Core.PodSelector.Component)
+	assert.Equal(t, []string{"proxysql-core-*", "10.0.0.0/8"}, envConfig.Core.PodAllowlist)
 
 	assert.Equal(t, 5533, envConfig.Satellite.Interval)
 }
@@ -275,3 +754,125 @@ func TestPrecedence(t *testing.T) {
 		assert.Equal(t, "flagtest", configs.Core.PodSelector.Component)
 	})
 }
+
+func TestClusterPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		adminPort   int
+		clusterPort int
+		want        int
+		wantErr     bool
+	}{
+		{"defaults to the admin port", "127.0.0.1:6032", 0, 0, 6032, false},
+		{"non-default address port", "127.0.0.1:7032", 0, 0, 7032, false},
+		{"defaults to admin_port", "127.0.0.1:6032", 7032, 0, 7032, false},
+		{"cluster port overrides the admin port", "127.0.0.1:6032", 7032, 6042, 6042, false},
+		{"missing port", "127.0.0.1", 0, 0, 0, true},
+		{"empty port", "127.0.0.1:", 0, 0, 0, true},
+		{"non-numeric port", "127.0.0.1:admin", 0, 0, 0, true},
+		{"ipv6 address", "[fd00::1]:6032", 0, 0, 6032, false},
+		{"ipv6 loopback", "[::1]:7032", 0, 0, 7032, false},
+		{"ipv6 without a port", "::1", 0, 0, 0, true},
+		{"bracketed ipv6 without a port", "[fd00::1]", 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := &Config{}
+			settings.ProxySQL.Address = tt.address
+			settings.ProxySQL.AdminPort = tt.adminPort
+			settings.ProxySQL.ClusterPort = tt.clusterPort
+
+			port, err := settings.ClusterPort()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrMissingPort)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, port)
+		})
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	settings := &Config{}
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+
+	address, err := settings.AdminAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:6032", address)
+
+	settings.ProxySQL.AdminPort = 7032
+
+	address, err = settings.AdminAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7032", address)
+
+	settings.ProxySQL.Address = "proxysql"
+
+	address, err = settings.AdminAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "proxysql:7032", address)
+
+	settings.ProxySQL.Address = "[fd00::1]:6032"
+
+	address, err = settings.AdminAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "[fd00::1]:7032", address)
+}
+
+func TestPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+
+	err := os.WriteFile(file, []byte("from-file\n"), 0o600)
+	assert.NoError(t, err)
+
+	viper.Reset()
+
+	os.Args = []string{"cmd", "--proxysql.password=from-flag", "--proxysql.password_file=" + file}
+	pflag.CommandLine = pflag.NewFlagSet("cmd", pflag.ContinueOnError)
+
+	settings, err := Configure()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", settings.ProxySQL.Password)
+}
+
+func TestEffectiveJSON(t *testing.T) {
+	settings := &Config{}
+	settings.RunMode = "satellite"
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.ProxySQL.Password = "hunter2"
+	settings.API.AuthToken = "s3cr3t"
+	settings.Notifications.WebhookURL = "https://hooks.slack.com/services/T000/B000/members"
+	settings.Notifications.AlertWebhookURL = "https://hooks.slack.com/services/T000/B000/alerts"
+	settings.Shutdown.PhaseWebhookURL = "https://hooks.example.com/phases?token=phases"
+
+	out, err := settings.EffectiveJSON()
+	assert.NoError(t, err)
+
+	var effective map[string]any
+
+	assert.NoError(t, json.Unmarshal([]byte(out), &effective))
+	assert.Equal(t, "satellite", effective["run_mode"])
+
+	proxysql, ok := effective["proxysql"].(map[string]any)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:6032", proxysql["address"])
+	assert.Equal(t, "REDACTED", proxysql["password"])
+	assert.NotContains(t, out, "hunter2")
+	assert.NotContains(t, out, "s3cr3t")
+	assert.NotContains(t, out, "members")
+	assert.NotContains(t, out, "alerts")
+	assert.NotContains(t, out, "phases")
+
+	notifications, ok := effective["notifications"].(map[string]any)
+	assert.True(t, ok)
+	assert.Equal(t, "REDACTED", notifications["webhook_url"])
+	assert.Equal(t, "REDACTED", notifications["alert_webhook_url"])
+
+	// the original settings aren't modified
+	assert.Equal(t, "hunter2", settings.ProxySQL.Password)
+}
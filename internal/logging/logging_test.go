@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextHandler(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := slog.New(NewContextHandler(slog.NewJSONHandler(&buf, nil))).With(slog.String("component", "test"))
+
+	t.Run("with a request id", func(t *testing.T) {
+		buf.Reset()
+
+		ctx := WithRequestID(context.Background(), "abc123")
+		logger.InfoContext(ctx, "hello")
+
+		var line map[string]any
+
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "abc123", line["request_id"])
+		assert.Equal(t, "test", line["component"])
+	})
+
+	t.Run("without a request id", func(t *testing.T) {
+		buf.Reset()
+
+		logger.InfoContext(context.Background(), "hello")
+
+		var line map[string]any
+
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.NotContains(t, line, "request_id")
+	})
+}
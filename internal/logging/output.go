@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"io"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// NewWriter returns the destination for log.output. stdout and stderr are returned as-is; anything else is
+// treated as a file path and wrapped in a rotating writer, so that long running pods don't fill the disk.
+// The caller should Close the writer on shutdown.
+func NewWriter(output string, maxSizeMB, maxBackups, maxAgeDays int) io.WriteCloser {
+	switch output {
+	case "", "stdout":
+		return nopCloser{os.Stdout}
+	case "stderr":
+		return nopCloser{os.Stderr}
+	default:
+		return &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAgeDays,
+		}
+	}
+}
+
+// Closing stdout or stderr would swallow anything logged after the writer is closed, so don't.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
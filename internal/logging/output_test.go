@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func TestNewWriter(t *testing.T) {
+	t.Run("stdout and stderr aren't rotated", func(t *testing.T) {
+		for _, output := range []string{"", "stdout", "stderr"} {
+			writer := NewWriter(output, 100, 3, 28)
+
+			assert.IsType(t, nopCloser{}, writer)
+			assert.NoError(t, writer.Close())
+		}
+	})
+
+	t.Run("files are rotated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.log")
+
+		writer := NewWriter(path, 100, 3, 28)
+
+		rotator, ok := writer.(*lumberjack.Logger)
+		assert.True(t, ok)
+		assert.Equal(t, path, rotator.Filename)
+		assert.Equal(t, 100, rotator.MaxSize)
+		assert.Equal(t, 3, rotator.MaxBackups)
+		assert.Equal(t, 28, rotator.MaxAge)
+
+		_, err := writer.Write([]byte("hello\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		contents, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", string(contents))
+	})
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ClusterMembers is the number of entries in proxysql_servers, as seen by this pod. Alerting on this is
+// simpler than on the membership events, eg: members != the expected number of core replicas.
+//
+//nolint:gochecknoglobals
+var ClusterMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "proxysql_cluster_members",
+	Help: "Number of servers in the proxysql_servers table.",
+})
+
+// ShutdownDuration is how long the graceful shutdown took, from the start of the drain until proxysql was
+// killed, for tuning drain timeouts against real deploys.
+//
+//nolint:gochecknoglobals
+var ShutdownDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "proxysql_shutdown_duration_seconds",
+	Help:    "Time taken by the graceful shutdown, including the drain.",
+	Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+})
+
+// DrainsTotal counts the drains by how they ended; either the drain condition that was met (eg: connections),
+// timeout when shutdown.drain_timeout expired, or cancelled when the drain was cut short (eg: by the watchdog).
+//
+//nolint:gochecknoglobals
+var DrainsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "proxysql_drains_total",
+	Help: "Number of drains, by how they ended.",
+}, []string{"result"})
+
+// DrainClientsRemaining is the number of clients that were connected at the last check while draining; after
+// the shutdown, it's the number of clients that were cut off.
+//
+//nolint:gochecknoglobals
+var DrainClientsRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "proxysql_drain_clients_remaining",
+	Help: "Clients connected to proxysql at the last check while draining.",
+})
+
+// Backends is the number of backends in runtime_mysql_servers by status (total, online or shunned), as of the
+// last probe.
+//
+//nolint:gochecknoglobals
+var Backends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "proxysql_backends",
+	Help: "Number of backends in runtime_mysql_servers at the last probe, by status.",
+}, []string{"status"})
+
+// ResyncsTotal counts the times proxysql_servers was reloaded to rejoin the cluster, and the resyncs forced
+// through the API.
+//
+//nolint:gochecknoglobals
+var ResyncsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "proxysql_resyncs_total",
+	Help: "Number of proxysql_servers reloads.",
+})
+
+// CommandFailuresTotal counts the admin commands that returned an error, eg: a LOAD ... TO RUNTIME that failed
+// while a pod was joining the cluster.
+//
+//nolint:gochecknoglobals
+var CommandFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "proxysql_command_failures_total",
+	Help: "Number of admin commands that failed.",
+})
+
+// KeepaliveFailuresTotal counts the keepalive pings of the admin interface that failed.
+//
+//nolint:gochecknoglobals
+var KeepaliveFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "proxysql_keepalive_failures_total",
+	Help: "Number of keepalive pings of the admin interface that failed.",
+})
+
+// ShutdownPhase is the current phase of the shutdown; 0 while running, then 1 draining, 2 stopping and 3 stopped.
+//
+//nolint:gochecknoglobals
+var ShutdownPhase = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "proxysql_shutdown_phase",
+	Help: "Current shutdown phase: 0 running, 1 draining, 2 stopping, 3 stopped.",
+})
+
+//nolint:gochecknoglobals
+var registerOnce sync.Once
+
+// Register adds the agent's metrics to the default registry, so that they're served by Handler. The metrics can
+// still be updated when they aren't registered, they just aren't exported.
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(
+			ClusterMembers,
+			ShutdownDuration,
+			DrainsTotal,
+			DrainClientsRemaining,
+			Backends,
+			ResyncsTotal,
+			CommandFailuresTotal,
+			KeepaliveFailuresTotal,
+			ShutdownPhase,
+		)
+	})
+}
+
+// Handler serves the registered metrics in the prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// LogRuntimeStats logs the agent's goroutine count, heap and GC stats at DEBUG every interval, until the context
+// is cancelled; it returns straight away if the interval is 0. The same stats are exported on /metrics by the
+// default registry's Go collector (go_goroutines, go_memstats_heap_alloc_bytes, go_gc_duration_seconds).
+func LogRuntimeStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		slog.Debug("Runtime stats", runtimeStats()...)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runtimeStats() []any {
+	var stats runtime.MemStats
+
+	runtime.ReadMemStats(&stats)
+
+	return []any{
+		slog.Int("goroutines", runtime.NumGoroutine()),
+		slog.Uint64("heap_alloc_bytes", stats.HeapAlloc),
+		slog.Uint64("heap_objects", stats.HeapObjects),
+		slog.Uint64("gc_cycles", uint64(stats.NumGC)),
+		slog.Duration("gc_pause_total", time.Duration(stats.PauseTotalNs)),
+	}
+}
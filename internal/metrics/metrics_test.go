@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeStats(t *testing.T) {
+	keys := []string{}
+
+	for _, attr := range runtimeStats() {
+		keys = append(keys, attr.(slog.Attr).Key)
+	}
+
+	assert.Equal(t, []string{"goroutines", "heap_alloc_bytes", "heap_objects", "gc_cycles", "gc_pause_total"}, keys)
+}
+
+func TestLogRuntimeStatsDisabled(t *testing.T) {
+	// returns straight away rather than blocking until the context is cancelled
+	LogRuntimeStats(context.Background(), 0)
+}
+
+func TestHandler(t *testing.T) {
+	Register()
+	Register() // registering twice is a no-op, rather than a panic
+
+	ClusterMembers.Set(3)
+	Backends.WithLabelValues("shunned").Set(1)
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, err := io.ReadAll(recorder.Body)
+
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "proxysql_cluster_members 3")
+	assert.Contains(t, string(body), `proxysql_backends{status="shunned"} 1`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -1,14 +1,21 @@
 package proxysql
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"path"
 	"strings"
 	"time"
 
 	// This comment is reqiured to pass golint.
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/persona-id/proxysql-agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -17,6 +24,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // ProxySQL core functions.
@@ -39,26 +47,22 @@ import (
 //   - When a satellite pod leaves the cluster, nothing needs to be done.
 //   - When a core pod leaves the cluster, the remaining core pods all delete that pod from the proxysql_servers
 //     table and run all of the LOAD X TO RUNTIME commands.
-func (p *ProxySQL) Core() {
-	if p.clientset == nil {
-		config, err := rest.InClusterConfig()
-		if err != nil {
-			slog.Error("error", slog.Any("err", err))
-			panic(err)
-		}
+//
+// The function blocks until the context is cancelled or the pod is shut down via the preStop hook.
+func (p *ProxySQL) Core(ctx context.Context) error {
+	if err := p.setupClientset(); err != nil {
+		slog.Error("error", slog.Any("err", err))
+		return err
+	}
 
-		clientset, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			slog.Error("error", slog.Any("err", err))
-			panic(err)
-		}
+	removeStaleDrainFile()
 
-		p.clientset = clientset
-	}
+	// stop signal for the informer; it's tied to the context so that a shutdown while the cache is still syncing
+	// (eg: when the API server is unreachable) isn't stuck waiting for it
+	informerCtx, stopInformer := context.WithCancel(ctx)
+	defer stopInformer()
 
-	// stop signal for the informer
-	stopper := make(chan struct{})
-	defer close(stopper)
+	stopper := informerCtx.Done()
 
 	app := p.settings.Core.PodSelector.App
 	namespace := p.settings.Core.PodSelector.Namespace
@@ -69,7 +73,7 @@ func (p *ProxySQL) Core() {
 
 	factory := informers.NewSharedInformerFactoryWithOptions(
 		p.clientset,
-		1*time.Second,
+		time.Duration(p.settings.Core.InformerResync)*time.Second,
 		informers.WithNamespace(namespace),
 		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
 			options.LabelSelector = labelSelector.String()
@@ -78,26 +82,103 @@ func (p *ProxySQL) Core() {
 
 	podInformer := factory.Core().V1().Pods().Informer()
 
+	// register the handlers before starting the informer, so that no events are missed between the
+	// cache syncing and the handlers being added. the pods that already exist are delivered to podAdded.
+	_, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    p.podAdded,
+		UpdateFunc: p.podUpdated,
+		DeleteFunc: p.podDeleted,
+	})
+	if err != nil {
+		slog.Error("Error creating Informer", slog.Any("err", err))
+		return err
+	}
+
 	defer runtime.HandleCrash()
 
 	go factory.Start(stopper)
 
 	if !cache.WaitForCacheSync(stopper, podInformer.HasSynced) {
-		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
-		return
+		if err := ctx.Err(); err != nil {
+			slog.Info("Core loop stopping before the pod cache synced")
+
+			return err
+		}
+
+		err := fmt.Errorf("Timed out waiting for caches to sync")
+		runtime.HandleError(err)
+
+		return err
 	}
 
-	_, err := podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    p.podAdded,
-		UpdateFunc: p.podUpdated,
-	})
+	p.updateClusterMembers()
+
+	// block the main go routine from exiting. core pods don't need to drain, so there's nothing
+	// else to do when the context is cancelled, unless the preStop hook has already started a shutdown.
+	select {
+	case <-ctx.Done():
+		if p.IsShuttingDown() {
+			slog.Info("Core loop stopping, waiting for the shutdown in progress")
+
+			return p.waitForShutdown()
+		}
+
+		slog.Info("Core loop stopping")
+
+		return nil
+	case <-p.Done():
+		return p.shutdownErr
+	}
+}
+
+// Core pods don't drain, so a drain file can only be left over from an older agent (or a satellite run in
+// the same volume). Remove it, otherwise the readiness probe reports the pod as draining.
+func removeStaleDrainFile() {
+	err := os.Remove(drainFile)
+
+	switch {
+	case err == nil:
+		slog.Warn("Removed a stale drain file", slog.String("path", drainFile))
+	case !os.IsNotExist(err):
+		slog.Error("Error removing drainFile", slog.String("path", drainFile), slog.Any("err", err))
+	}
+}
+
+// Set up the clientset used to talk to k8s, unless one has already been set (eg: in tests).
+func (p *ProxySQL) setupClientset() error {
+	if p.clientset != nil {
+		return nil
+	}
+
+	config, err := kubeConfig(p.settings.Kube.ConfigPath)
 	if err != nil {
-		slog.Error("Error creating Informer", slog.Any("err", err))
-		panic(err)
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	p.clientset = clientset
+
+	return nil
+}
+
+// Use kube.config_path, or $KUBECONFIG, if set, so that the agent can be run outside of the cluster; otherwise
+// use the in-cluster config.
+func kubeConfig(path string) (*rest.Config, error) {
+	if path == "" {
+		path = os.Getenv("KUBECONFIG")
+	}
+
+	if path == "" {
+		return rest.InClusterConfig()
 	}
 
-	// block the main go routine from exiting
-	<-stopper
+	slog.Info("Using a kubeconfig to talk to k8s", slog.String("path", path))
+
+	return clientcmd.BuildConfigFromFlags("", path)
 }
 
 // This function is needed to do bootstrapping. At first I was using podUpdated to do adds, but we would never
@@ -117,13 +198,15 @@ func (p *ProxySQL) podAdded(object interface{}) {
 		return
 	}
 
+	if missingPodIP(pod) {
+		return
+	}
+
 	// check if pod is already in the proxysql_servers table; this can happen when core pods add
 	// other core pods.
 	var count int
 
-	cmd := fmt.Sprintf("SELECT count(*) FROM proxysql_servers WHERE hostname = %q", pod.Status.PodIP)
-
-	err := p.conn.QueryRow(cmd).Scan(&count)
+	err := p.conn.QueryRow("SELECT count(*) FROM proxysql_servers WHERE hostname = " + sqlString(podHostname(pod))).Scan(&count)
 	if err != nil {
 		slog.Error("Error in podAdded()", slog.Any("err", err))
 	}
@@ -160,8 +243,13 @@ func (p *ProxySQL) podUpdated(oldobject interface{}, newobject interface{}) {
 		return
 	}
 
-	// Pod is new and transitioned to running, so we add that to the proxysql_servers table.
-	if oldpod.Status.Phase == "Pending" && newpod.Status.Phase == "Running" {
+	// Pod is new and transitioned to running, so we add that to the proxysql_servers table. A pod can be running
+	// before it's been assigned an IP; it's skipped then, and added by the update that assigns the IP instead.
+	started := oldpod.Status.Phase == "Pending" && newpod.Status.Phase == "Running"
+	assignedIP := oldpod.Status.Phase == "Running" && newpod.Status.Phase == "Running" &&
+		oldpod.Status.PodIP == "" && newpod.Status.PodIP != ""
+
+	if (started || assignedIP) && !missingPodIP(newpod) {
 		err := p.addPodToCluster(newpod)
 		if err != nil {
 			slog.Error("Error in addPod()", slog.Any("err", err))
@@ -178,68 +266,180 @@ func (p *ProxySQL) podUpdated(oldobject interface{}, newobject interface{}) {
 	}
 }
 
+// A core pod that's deleted outright (eg: kubectl delete --force, or its node going away) never goes through the
+// Running -> Failed update, so it's removed from the cluster here instead. Removing a pod that podUpdated has
+// already removed is harmless.
+func (p *ProxySQL) podDeleted(object interface{}) {
+	// if the informer missed the delete, it hands over the last state it knew of the pod instead
+	if tombstone, ok := object.(cache.DeletedFinalStateUnknown); ok {
+		object = tombstone.Obj
+	}
+
+	pod, ok := object.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	// satellites don't need anything done when they leave, and a pod without an IP was never added
+	if pod.Labels["component"] != "core" || pod.Status.PodIP == "" {
+		return
+	}
+
+	err := p.removePodFromCluster(pod)
+	if err != nil {
+		slog.Error("Error in podDeleted()", slog.Any("err", err))
+	}
+}
+
+// Pods without an IP can't be added to the cluster; an empty hostname in proxysql_servers breaks it.
+func missingPodIP(pod *v1.Pod) bool {
+	if pod.Status.PodIP != "" {
+		return false
+	}
+
+	slog.Warn("Pod has no IP yet, it will be added to the cluster once it has one", slog.String("name", pod.Name))
+
+	return true
+}
+
 // Add the new pod to the cluster.
 //   - If it's a core pod, add it to the proxysql_servers table
 //   - if it's a satellite pod, run the commands to accept it to the cluster
-func (p *ProxySQL) addPodToCluster(pod *v1.Pod) error {
-	slog.Info("Pod joined the cluster", slog.String("name", pod.Name), slog.String("ip", pod.Status.PodIP))
+func (p *ProxySQL) addPodToCluster(pod *v1.Pod) (err error) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "addPodToCluster", trace.WithAttributes(podAttributes(pod)...))
+	defer func() { tracing.End(span, err) }()
 
-	commands := []string{"DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'"}
+	if !p.podAllowed(pod) {
+		slog.Warn("Pod is not in core.pod_allowlist, not adding it to the cluster",
+			slog.String("name", pod.Name), slog.String("ip", pod.Status.PodIP))
 
-	// If the new pod is a core pod, delete the default entries in the proxysql_server list and add the new pod to it.
-	if pod.Labels["component"] == "core" {
-		// TODO: maybe make this configurable, not everyone will name the service this.
-		commands = append(commands, fmt.Sprintf("INSERT INTO proxysql_servers VALUES (%q, 6032, 0, %q)", pod.Status.PodIP, pod.Name))
+		return nil
 	}
 
-	commands = append(commands,
-		"LOAD PROXYSQL SERVERS TO RUNTIME",
-		"LOAD ADMIN VARIABLES TO RUNTIME",
-		"LOAD MYSQL VARIABLES TO RUNTIME",
-		"LOAD MYSQL SERVERS TO RUNTIME",
-		"LOAD MYSQL USERS TO RUNTIME",
-		"LOAD MYSQL QUERY RULES TO RUNTIME",
-	)
+	slog.Info("Pod joined the cluster", slog.String("name", pod.Name), slog.String("ip", pod.Status.PodIP))
 
-	for _, command := range commands {
-		_, err := p.conn.Exec(command)
+	// the default entry for the core service, satellite.core_hostname, is replaced by the pods themselves
+	commands := []string{"DELETE FROM proxysql_servers WHERE hostname = " + sqlString(p.settings.Satellite.CoreHostname)}
+
+	// If the new pod is a core pod, delete the default entries in the proxysql_server list and add the new pod to it.
+	if pod.Labels["component"] == "core" {
+		port, err := p.settings.ClusterPort()
 		if err != nil {
-			// FIXME: wrap error with extra info and return
-			slog.Error("Command failed", slog.String("command", command), slog.Any("error", err))
+			slog.Error("Unable to determine the cluster port", slog.Any("error", err))
 			return err
 		}
+
+		commands = append(commands,
+			fmt.Sprintf("INSERT INTO proxysql_servers VALUES (%s, %d, 0, %s)", sqlString(podHostname(pod)), port, sqlString(pod.Name)))
 	}
 
-	slog.Debug("Ran commands", slog.Any("commands", strings.Join(commands, ", ")))
+	err = p.execCommands(ctx, commands)
+	if err != nil {
+		return err
+	}
+
+	p.notifyMembershipChange("pod_joined", pod, p.updateClusterMembers())
 
 	return nil
 }
 
+// Check the pod against core.pod_allowlist; this guards against a misbehaving pod registering itself. Entries
+// are either CIDRs, which are matched against the pod IP, or patterns (see path.Match), which are matched
+// against the pod name. An empty allowlist allows every pod.
+func (p *ProxySQL) podAllowed(pod *v1.Pod) bool {
+	allowlist := p.settings.Core.PodAllowlist
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(pod.Status.PodIP)
+
+	for _, entry := range allowlist {
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if matched, _ := path.Match(entry, pod.Name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The value to use for the pod in proxysql_servers.hostname. The port lives in its own column, so IPv6 addresses
+// are stored bare rather than bracketed, and in their canonical form so that the same pod always matches the same
+// row (eg: FD00:0:0::0A and fd00::a). Anything that doesn't parse as an IP is used as-is.
+func podHostname(pod *v1.Pod) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(pod.Status.PodIP, "["), "]")
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return pod.Status.PodIP
+}
+
 // Remove a core pod from the cluster when it leaves. This function just deletes the pod from
 // proxysql_servers based on the hostname (PodIP here, technically). The function then runs all the
 // LOAD TO RUNTIME commands required to sync state to the rest of the cluster.
-func (p *ProxySQL) removePodFromCluster(pod *v1.Pod) error {
+func (p *ProxySQL) removePodFromCluster(pod *v1.Pod) (err error) {
+	ctx, span := tracing.Tracer().Start(context.Background(), "removePodFromCluster", trace.WithAttributes(podAttributes(pod)...))
+	defer func() { tracing.End(span, err) }()
+
 	slog.Info("Pod left the cluster", slog.String("name", pod.Name), slog.String("ip", pod.Status.PodIP))
 
 	commands := []string{}
 
 	if pod.Labels["component"] == "core" {
-		commands = append(commands, fmt.Sprintf("DELETE FROM proxysql_servers WHERE hostname = %q", pod.Status.PodIP))
+		commands = append(commands, "DELETE FROM proxysql_servers WHERE hostname = "+sqlString(podHostname(pod)))
 	}
 
-	commands = append(commands,
-		"LOAD PROXYSQL SERVERS TO RUNTIME",
-		"LOAD ADMIN VARIABLES TO RUNTIME",
-		"LOAD MYSQL VARIABLES TO RUNTIME",
-		"LOAD MYSQL SERVERS TO RUNTIME",
-		"LOAD MYSQL USERS TO RUNTIME",
-		"LOAD MYSQL QUERY RULES TO RUNTIME",
-	)
+	err = p.execCommands(ctx, commands)
+	if err != nil {
+		return err
+	}
+
+	p.notifyMembershipChange("pod_left", pod, p.updateClusterMembers())
+
+	return nil
+}
+
+var loadToRuntimeCommands = []string{ //nolint:gochecknoglobals
+	"LOAD PROXYSQL SERVERS TO RUNTIME",
+	"LOAD ADMIN VARIABLES TO RUNTIME",
+	"LOAD MYSQL VARIABLES TO RUNTIME",
+	"LOAD MYSQL SERVERS TO RUNTIME",
+	"LOAD MYSQL USERS TO RUNTIME",
+	"LOAD MYSQL QUERY RULES TO RUNTIME",
+}
+
+// Quote a value as an SQL string literal. The admin interface parses statements as SQLite, which doesn't treat
+// backslashes as escapes, so placeholders filled in by the driver aren't safe there; the only escape is doubling
+// the single quotes.
+func sqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Run the proxysql_servers changes for a pod joining or leaving, followed by the LOAD TO RUNTIME commands that
+// sync them to the rest of the cluster. Stops at the first failure.
+func (p *ProxySQL) execCommands(ctx context.Context, commands []string) error {
+	commands = append(commands, loadToRuntimeCommands...)
+
+	p.resyncMu.Lock()
+	defer p.resyncMu.Unlock()
 
 	for _, command := range commands {
-		_, err := p.conn.Exec(command)
+		_, err := p.conn.ExecContext(ctx, command)
 		if err != nil {
-			slog.Error("Command failed", slog.Any("command", command), slog.Any("error", err))
+			// FIXME: wrap error with extra info and return
+			slog.Error("Command failed", slog.String("command", command), slog.Any("error", err))
+			metrics.CommandFailuresTotal.Inc()
+
 			return err
 		}
 	}
@@ -248,3 +448,28 @@ func (p *ProxySQL) removePodFromCluster(pod *v1.Pod) error {
 
 	return nil
 }
+
+// Span attributes identifying the pod joining or leaving the cluster.
+func podAttributes(pod *v1.Pod) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("pod.name", pod.Name),
+		attribute.String("pod.ip", pod.Status.PodIP),
+		attribute.String("pod.component", pod.Labels["component"]),
+	}
+}
+
+// Refresh the proxysql_cluster_members gauge; this runs after every membership change. Returns the number of
+// members, or -1 if they couldn't be counted.
+func (p *ProxySQL) updateClusterMembers() int {
+	var members int
+
+	err := p.conn.QueryRow("SELECT count(*) FROM proxysql_servers").Scan(&members)
+	if err != nil {
+		slog.Error("Unable to count the cluster members", slog.Any("error", err))
+		return -1
+	}
+
+	metrics.ClusterMembers.Set(float64(members))
+
+	return members
+}
@@ -1,24 +1,130 @@
 package proxysql
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DATA-DOG/go-sqlmock.v2"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 )
 
+func expectClusterMembers(mock sqlmock.Sqlmock, members int) {
+	mock.ExpectQuery(
+		regexp.QuoteMeta("SELECT count(*) FROM proxysql_servers") + "$",
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(members),
+	)
+}
+
 func TestCore(t *testing.T) {
-	t.Run("TODO", func(t *testing.T) {
-		fmt.Println("TODO")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Core.PodSelector.Namespace = "proxysql"
+	settings.Core.PodSelector.App = "proxysql"
+
+	hostname, _ := os.Hostname()
+
+	// this pod exists before the informer starts, so it should be delivered to podAdded
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hostname,
+			Namespace: "proxysql",
+			Labels: map[string]string{
+				"app":       "proxysql",
+				"component": "core",
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: "Running",
+			PodIP: "pod-ip",
+		},
+	}
+
+	p := &ProxySQL{conn: db, settings: settings, clientset: fake.NewSimpleClientset(pod)}
+
+	// the existing pod may be delivered to podAdded before or after the cluster members gauge is first updated
+	mock.MatchExpectationsInOrder(false)
+
+	expectClusterMembers(mock, 1)
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta(`SELECT count(*) FROM proxysql_servers WHERE hostname = 'pod-ip'`),
+	).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(1),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
 
-		t.Skipped()
+	go func() {
+		done <- p.Core(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, 5*time.Second, 10*time.Millisecond, "existing pod should be delivered to podAdded")
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Core() should return when the context is cancelled")
+	}
+}
+
+func TestCoreCancelledBeforeSync(t *testing.T) {
+	settings := &configuration.Config{}
+	settings.Core.PodSelector.Namespace = "proxysql"
+	settings.Core.PodSelector.App = "proxysql"
+
+	// the API server can't be reached, so the pod cache never syncs
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "pods", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		return true, nil, errors.New("connection refused")
 	})
+
+	p := &ProxySQL{settings: settings, clientset: clientset}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- p.Core(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Error("Core() should return when the context is cancelled while the cache is syncing")
+	}
 }
 
 func TestPodUpdated(t *testing.T) {
@@ -30,7 +136,7 @@ func TestPodUpdated(t *testing.T) {
 
 	mock.MatchExpectationsInOrder(true)
 
-	p := &ProxySQL{db, tmpConfig, nil}
+	p := &ProxySQL{conn: db, settings: tmpConfig}
 
 	oldpod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -65,7 +171,7 @@ func TestPodUpdated(t *testing.T) {
 		mock.ExpectExec("DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'").WillReturnResult(sqlmock.NewResult(0, 1))
 
 		mock.ExpectExec(
-			regexp.QuoteMeta(`INSERT INTO proxysql_servers VALUES ("new-pod-ip", 6032, 0, "new-pod")`),
+			regexp.QuoteMeta(`INSERT INTO proxysql_servers VALUES ('new-pod-ip', 6032, 0, 'new-pod')`),
 		).WillReturnResult(
 			sqlmock.NewResult(0, 1),
 		)
@@ -81,6 +187,8 @@ func TestPodUpdated(t *testing.T) {
 			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
 		}
 
+		expectClusterMembers(mock, 1)
+
 		p.podUpdated(oldpod, newpod)
 	})
 
@@ -89,7 +197,7 @@ func TestPodUpdated(t *testing.T) {
 		newpod.Status.Phase = "Failed"
 
 		mock.ExpectExec(
-			`DELETE FROM proxysql_servers WHERE hostname = "old-pod-ip"`,
+			regexp.QuoteMeta(`DELETE FROM proxysql_servers WHERE hostname = 'old-pod-ip'`),
 		).WillReturnResult(
 			sqlmock.NewResult(0, 1),
 		)
@@ -105,6 +213,8 @@ func TestPodUpdated(t *testing.T) {
 			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
 		}
 
+		expectClusterMembers(mock, 1)
+
 		p.podUpdated(oldpod, newpod)
 	})
 
@@ -124,7 +234,7 @@ func TestPodAdded(t *testing.T) {
 
 	mock.MatchExpectationsInOrder(true)
 
-	p := &ProxySQL{db, tmpConfig, nil}
+	p := &ProxySQL{conn: db, settings: tmpConfig}
 
 	// we have to do a little hostname trickery for this test, as podAdded will immediately return for any pods
 	// that aren't processing themselves.
@@ -146,7 +256,7 @@ func TestPodAdded(t *testing.T) {
 	t.Run("core pod already exists in cluster", func(_ *testing.T) {
 		// Expect the query and return the row set
 		mock.ExpectQuery(
-			regexp.QuoteMeta(`SELECT count(*) FROM proxysql_servers WHERE hostname = "pod-ip"`),
+			regexp.QuoteMeta(`SELECT count(*) FROM proxysql_servers WHERE hostname = 'pod-ip'`),
 		).WillReturnRows(
 			sqlmock.NewRows([]string{"count"}).AddRow(1),
 		)
@@ -157,7 +267,7 @@ func TestPodAdded(t *testing.T) {
 	t.Run("core pod does not exist in cluster", func(_ *testing.T) {
 		// Expect the query and return the row set
 		mock.ExpectQuery(
-			regexp.QuoteMeta(`SELECT count(*) FROM proxysql_servers WHERE hostname = "pod-ip"`),
+			regexp.QuoteMeta(`SELECT count(*) FROM proxysql_servers WHERE hostname = 'pod-ip'`),
 		).WillReturnRows(
 			sqlmock.NewRows([]string{"count"}).AddRow(0),
 		)
@@ -166,7 +276,7 @@ func TestPodAdded(t *testing.T) {
 
 		hostname, _ := os.Hostname()
 		mock.ExpectExec(
-			regexp.QuoteMeta(fmt.Sprintf(`INSERT INTO proxysql_servers VALUES ("pod-ip", 6032, 0, %q)`, hostname)),
+			regexp.QuoteMeta(fmt.Sprintf(`INSERT INTO proxysql_servers VALUES ('pod-ip', 6032, 0, '%s')`, hostname)),
 		).WillReturnResult(
 			sqlmock.NewResult(0, 1),
 		)
@@ -182,6 +292,8 @@ func TestPodAdded(t *testing.T) {
 			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
 		}
 
+		expectClusterMembers(mock, 1)
+
 		p.podAdded(pod)
 	})
 
@@ -192,6 +304,74 @@ func TestPodAdded(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPodWithoutIP(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	newPod := func(phase v1.PodPhase, ip string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      hostname,
+				Namespace: "test-ns",
+				Labels: map[string]string{
+					"component": "core",
+				},
+			},
+			Status: v1.PodStatus{
+				Phase: phase,
+				PodIP: ip,
+			},
+		}
+	}
+
+	expectAdd := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec("DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(
+			regexp.QuoteMeta(fmt.Sprintf(`INSERT INTO proxysql_servers VALUES ('pod-ip', 6032, 0, '%s')`, hostname)),
+		).WillReturnResult(
+			sqlmock.NewResult(0, 1),
+		)
+
+		for _, cmd := range []string{
+			"LOAD PROXYSQL SERVERS TO RUNTIME",
+			"LOAD ADMIN VARIABLES TO RUNTIME",
+			"LOAD MYSQL VARIABLES TO RUNTIME",
+			"LOAD MYSQL SERVERS TO RUNTIME",
+			"LOAD MYSQL USERS TO RUNTIME",
+			"LOAD MYSQL QUERY RULES TO RUNTIME",
+		} {
+			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		expectClusterMembers(mock, 1)
+	}
+
+	t.Run("podAdded", func(t *testing.T) {
+		// no queries should run for a pod without an IP
+		db, mock := newStrictMock(t)
+
+		p := &ProxySQL{conn: db, settings: tmpConfig}
+
+		p.podAdded(newPod("Running", ""))
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("podUpdated", func(t *testing.T) {
+		db, mock := newStrictMock(t)
+
+		p := &ProxySQL{conn: db, settings: tmpConfig}
+
+		p.podUpdated(newPod("Pending", ""), newPod("Running", ""))
+
+		// the pod is added once it's been assigned an IP
+		expectAdd(mock)
+
+		p.podUpdated(newPod("Running", ""), newPod("Running", "pod-ip"))
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
 func TestRemovePodFromCluster(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -201,11 +381,11 @@ func TestRemovePodFromCluster(t *testing.T) {
 
 	mock.MatchExpectationsInOrder(true)
 
-	p := &ProxySQL{db, tmpConfig, nil}
+	p := &ProxySQL{conn: db, settings: tmpConfig}
 
 	t.Run("core pod", func(t *testing.T) {
 		mock.ExpectExec(
-			`DELETE FROM proxysql_servers WHERE hostname = "pod-ip"`,
+			regexp.QuoteMeta(`DELETE FROM proxysql_servers WHERE hostname = 'pod-ip'`),
 		).WillReturnResult(
 			sqlmock.NewResult(0, 1),
 		)
@@ -221,6 +401,8 @@ func TestRemovePodFromCluster(t *testing.T) {
 			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
 		}
 
+		expectClusterMembers(mock, 1)
+
 		pod := &v1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "test-pod",
@@ -255,6 +437,8 @@ func TestRemovePodFromCluster(t *testing.T) {
 			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
 		}
 
+		expectClusterMembers(mock, 1)
+
 		pod := &v1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "test-pod",
@@ -274,3 +458,429 @@ func TestRemovePodFromCluster(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestPodDeleted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	corePod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "proxysql-core-1",
+			Namespace: "proxysql",
+			Labels: map[string]string{
+				"component": "core",
+			},
+		},
+		Status: v1.PodStatus{
+			PodIP: "pod-ip",
+		},
+	}
+
+	expectRemoved := func() {
+		mock.ExpectExec(
+			regexp.QuoteMeta(`DELETE FROM proxysql_servers WHERE hostname = 'pod-ip'`),
+		).WillReturnResult(
+			sqlmock.NewResult(0, 1),
+		)
+
+		for _, cmd := range []string{
+			"LOAD PROXYSQL SERVERS TO RUNTIME",
+			"LOAD ADMIN VARIABLES TO RUNTIME",
+			"LOAD MYSQL VARIABLES TO RUNTIME",
+			"LOAD MYSQL SERVERS TO RUNTIME",
+			"LOAD MYSQL USERS TO RUNTIME",
+			"LOAD MYSQL QUERY RULES TO RUNTIME",
+		} {
+			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		expectClusterMembers(mock, 1)
+	}
+
+	t.Run("core pod", func(t *testing.T) {
+		expectRemoved()
+
+		p.podDeleted(corePod)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("tombstone", func(t *testing.T) {
+		expectRemoved()
+
+		p.podDeleted(cache.DeletedFinalStateUnknown{Key: "proxysql/proxysql-core-1", Obj: corePod})
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("satellite pod", func(t *testing.T) {
+		// nothing needs to be done when a satellite leaves, so any command fails the test
+		db, mock := newStrictMock(t)
+
+		p := &ProxySQL{conn: db, settings: tmpConfig}
+
+		satellitePod := corePod.DeepCopy()
+		satellitePod.Labels["component"] = "satellite"
+
+		p.podDeleted(satellitePod)
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAddPodToClusterAllowlist(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.Satellite.CoreHostname = "proxysql-core"
+	settings.Core.PodAllowlist = []string{"proxysql-core-*", "10.1.0.0/16"}
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	expectCommands := func(ip, name string) {
+		mock.ExpectExec("DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		mock.ExpectExec(
+			regexp.QuoteMeta(fmt.Sprintf(`INSERT INTO proxysql_servers VALUES ('%s', 6032, 0, '%s')`, ip, name)),
+		).WillReturnResult(
+			sqlmock.NewResult(0, 1),
+		)
+
+		for _, cmd := range []string{
+			"LOAD PROXYSQL SERVERS TO RUNTIME",
+			"LOAD ADMIN VARIABLES TO RUNTIME",
+			"LOAD MYSQL VARIABLES TO RUNTIME",
+			"LOAD MYSQL SERVERS TO RUNTIME",
+			"LOAD MYSQL USERS TO RUNTIME",
+			"LOAD MYSQL QUERY RULES TO RUNTIME",
+		} {
+			mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		expectClusterMembers(mock, 1)
+	}
+
+	newPod := func(name, ip string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "test-ns",
+				Labels: map[string]string{
+					"component": "core",
+				},
+			},
+			Status: v1.PodStatus{
+				PodIP: ip,
+			},
+		}
+	}
+
+	t.Run("allowed by name", func(t *testing.T) {
+		expectCommands("192.168.0.10", "proxysql-core-0")
+
+		err := p.addPodToCluster(newPod("proxysql-core-0", "192.168.0.10"))
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("allowed by CIDR", func(t *testing.T) {
+		expectCommands("10.1.2.3", "some-other-pod")
+
+		err := p.addPodToCluster(newPod("some-other-pod", "10.1.2.3"))
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		// no commands should be run for this pod
+		err := p.addPodToCluster(newPod("rogue-pod", "172.16.0.5"))
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("empty allowlist allows all", func(t *testing.T) {
+		p := &ProxySQL{conn: db, settings: tmpConfig}
+
+		expectCommands("172.16.0.5", "rogue-pod")
+
+		err := p.addPodToCluster(newPod("rogue-pod", "172.16.0.5"))
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAddPodToClusterClusterPort(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.ProxySQL.ClusterPort = 6042
+	settings.Satellite.CoreHostname = "proxysql-core"
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "proxysql-core-0",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				"component": "core",
+			},
+		},
+		Status: v1.PodStatus{
+			PodIP: "pod-ip",
+		},
+	}
+
+	mock.ExpectExec("DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`INSERT INTO proxysql_servers VALUES ('pod-ip', 6042, 0, 'proxysql-core-0')`),
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+
+	for _, cmd := range []string{
+		"LOAD PROXYSQL SERVERS TO RUNTIME",
+		"LOAD ADMIN VARIABLES TO RUNTIME",
+		"LOAD MYSQL VARIABLES TO RUNTIME",
+		"LOAD MYSQL SERVERS TO RUNTIME",
+		"LOAD MYSQL USERS TO RUNTIME",
+		"LOAD MYSQL QUERY RULES TO RUNTIME",
+	} {
+		mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	expectClusterMembers(mock, 1)
+
+	err = p.addPodToCluster(pod)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddPodToClusterQuoting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.Satellite.CoreHostname = "core's-svc"
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	// the admin interface doesn't treat backslashes as escapes, so only the single quotes are doubled
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      `core\'); DELETE FROM mysql_users; --`,
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				"component": "core",
+			},
+		},
+		Status: v1.PodStatus{
+			PodIP: "pod-ip'",
+		},
+	}
+
+	mock.ExpectExec("^" + regexp.QuoteMeta(`DELETE FROM proxysql_servers WHERE hostname = 'core''s-svc'`) + "$").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(
+		"^" + regexp.QuoteMeta(`INSERT INTO proxysql_servers VALUES ('pod-ip''', 6032, 0, 'core\''); DELETE FROM mysql_users; --')`) + "$",
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+
+	for _, cmd := range loadToRuntimeCommands {
+		mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	expectClusterMembers(mock, 1)
+
+	err = p.addPodToCluster(pod)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPodHostname(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.2.3", "10.1.2.3"},
+		{"fd00::a", "fd00::a"},
+		{"FD00:0:0::0A", "fd00::a"},
+		{"[fd00::a]", "fd00::a"},
+		{"pod-ip", "pod-ip"},
+	}
+
+	for _, tt := range tests {
+		pod := &v1.Pod{Status: v1.PodStatus{PodIP: tt.ip}}
+
+		assert.Equal(t, tt.want, podHostname(pod), tt.ip)
+	}
+}
+
+func TestClusterMembershipIPv6(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "proxysql-core-0",
+			Namespace: "test-ns",
+			Labels: map[string]string{
+				"component": "core",
+			},
+		},
+		Status: v1.PodStatus{
+			PodIP: "FD00:0:0::0A",
+		},
+	}
+
+	loadCommands := []string{
+		"LOAD PROXYSQL SERVERS TO RUNTIME",
+		"LOAD ADMIN VARIABLES TO RUNTIME",
+		"LOAD MYSQL VARIABLES TO RUNTIME",
+		"LOAD MYSQL SERVERS TO RUNTIME",
+		"LOAD MYSQL USERS TO RUNTIME",
+		"LOAD MYSQL QUERY RULES TO RUNTIME",
+	}
+
+	mock.ExpectExec("DELETE FROM proxysql_servers WHERE hostname = 'proxysql-core'").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`INSERT INTO proxysql_servers VALUES ('fd00::a', 6032, 0, 'proxysql-core-0')`),
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+
+	for _, cmd := range loadCommands {
+		mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	expectClusterMembers(mock, 1)
+
+	mock.ExpectExec(
+		regexp.QuoteMeta(`DELETE FROM proxysql_servers WHERE hostname = 'fd00::a'`),
+	).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+
+	for _, cmd := range loadCommands {
+		mock.ExpectExec(cmd).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	expectClusterMembers(mock, 1)
+
+	assert.NoError(t, p.addPodToCluster(pod))
+	assert.NoError(t, p.removePodFromCluster(pod))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateClusterMembers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	expectClusterMembers(mock, 3)
+
+	p.updateClusterMembers()
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.InDelta(t, 3, testutil.ToFloat64(metrics.ClusterMembers), 0)
+}
+
+func TestKubeConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://k8s.example.com:6443
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: developer
+current-context: remote
+users:
+- name: developer
+  user:
+    token: secret
+`), 0o600)
+	assert.NoError(t, err)
+
+	t.Run("config path", func(t *testing.T) {
+		config, err := kubeConfig(kubeconfig)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "https://k8s.example.com:6443", config.Host)
+	})
+
+	t.Run("KUBECONFIG", func(t *testing.T) {
+		t.Setenv("KUBECONFIG", kubeconfig)
+
+		config, err := kubeConfig("")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "https://k8s.example.com:6443", config.Host)
+	})
+
+	t.Run("in-cluster", func(t *testing.T) {
+		t.Setenv("KUBECONFIG", "")
+		t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+		// not running in a pod, so there's no in-cluster config to fall back to
+		_, err := kubeConfig("")
+
+		assert.ErrorIs(t, err, rest.ErrNotInCluster)
+	})
+}
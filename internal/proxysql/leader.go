@@ -0,0 +1,100 @@
+package proxysql
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// How long a lease is held for, how long the leader keeps trying to renew it before giving it up, and how often
+// the other agents try to take it over; overridden in tests.
+//
+//nolint:gochecknoglobals
+var (
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 2 * time.Second
+)
+
+// IsLeader reports whether this agent should dump. Without dump.leader_election every agent does, as before.
+func (p *ProxySQL) IsLeader() bool {
+	if !p.settings.Dump.LeaderElection {
+		return true
+	}
+
+	return p.leader.Load()
+}
+
+// Start competing for the dump.lease_name lease in the background. The election runs until the context is
+// cancelled, and the lease is released then so that another agent can take over without waiting for it to
+// expire. The returned channel is closed once the first result is in, either this agent holding the lease or
+// another one being seen to hold it.
+func (p *ProxySQL) startLeaderElection(ctx context.Context) (<-chan struct{}, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = os.Getenv("HOSTNAME")
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      p.settings.Dump.LeaseName,
+			Namespace: p.settings.Core.PodSelector.Namespace,
+		},
+		Client:     p.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: hostname},
+	}
+
+	elected := make(chan struct{})
+
+	var once sync.Once
+
+	firstResult := func() { once.Do(func() { close(elected) }) }
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            p.settings.Dump.LeaseName,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseRenewDeadline,
+		RetryPeriod:     leaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				p.leader.Store(true)
+				firstResult()
+
+				slog.Info("Acquired the leader lease", slog.String("lease", p.settings.Dump.LeaseName))
+			},
+			OnStoppedLeading: func() {
+				p.leader.Store(false)
+
+				slog.Info("Lost the leader lease", slog.String("lease", p.settings.Dump.LeaseName))
+			},
+			OnNewLeader: func(identity string) {
+				// when this agent is the new leader, the first result is in once OnStartedLeading has run
+				if identity != hostname {
+					firstResult()
+				}
+
+				slog.Info("New leader elected", slog.String("lease", p.settings.Dump.LeaseName), slog.String("leader", identity))
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		// Run returns when the lease is lost, so stand for election again until the context is cancelled
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+
+	return elected, nil
+}
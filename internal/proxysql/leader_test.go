@@ -0,0 +1,181 @@
+package proxysql
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func leaderSettings(t *testing.T) *configuration.Config {
+	t.Helper()
+
+	settings := &configuration.Config{}
+	settings.Dump.LeaderElection = true
+	settings.Dump.LeaseName = "proxysql-agent-dump"
+	settings.Dump.Interval = 3600 // long enough that the ticker never fires during the test
+	settings.Dump.Tables = []string{"query_rule_stats"}
+	settings.Dump.OutputDir = t.TempDir()
+	settings.Core.PodSelector.Namespace = "proxysql"
+
+	return settings
+}
+
+// A lease held by another agent that won't expire during the test.
+func heldLease(holder string) *coordinationv1.Lease {
+	duration := int32(3600)
+	now := metav1.NewMicroTime(time.Now())
+
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "proxysql-agent-dump", Namespace: "proxysql"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+}
+
+func shortLeases(t *testing.T) {
+	t.Helper()
+
+	duration, renew, retry := leaseDuration, leaseRenewDeadline, leaseRetryPeriod
+	leaseDuration, leaseRenewDeadline, leaseRetryPeriod = time.Second, 500*time.Millisecond, 50*time.Millisecond
+
+	t.Cleanup(func() {
+		leaseDuration, leaseRenewDeadline, leaseRetryPeriod = duration, renew, retry
+	})
+}
+
+func TestIsLeaderWithoutElection(t *testing.T) {
+	p := &ProxySQL{settings: &configuration.Config{}}
+
+	assert.True(t, p.IsLeader(), "every agent dumps when leader election is disabled")
+}
+
+func TestLeaderElection(t *testing.T) {
+	shortLeases(t)
+
+	t.Run("acquires a free lease", func(t *testing.T) {
+		p := &ProxySQL{settings: leaderSettings(t), clientset: fake.NewSimpleClientset()}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		elected, err := p.startLeaderElection(ctx)
+		assert.NoError(t, err)
+
+		select {
+		case <-elected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the election should have a result")
+		}
+
+		assert.True(t, p.IsLeader(), "the first result should be this agent leading")
+
+		cancel()
+
+		assert.Eventually(t, func() bool { return !p.IsLeader() }, 5*time.Second, 10*time.Millisecond, "should give up the lease when cancelled")
+	})
+
+	t.Run("follows while another agent holds the lease", func(t *testing.T) {
+		p := &ProxySQL{settings: leaderSettings(t), clientset: fake.NewSimpleClientset(heldLease("proxysql-satellite-1"))}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		elected, err := p.startLeaderElection(ctx)
+		assert.NoError(t, err)
+
+		select {
+		case <-elected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the election should have a result")
+		}
+
+		assert.False(t, p.IsLeader())
+	})
+}
+
+func TestDumpLoopLeader(t *testing.T) {
+	shortLeases(t)
+
+	t.Run("the leader dumps straight away", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		assert.NoError(t, err, "Error creating mock database")
+
+		defer db.Close()
+
+		p := &ProxySQL{conn: db, settings: leaderSettings(t), clientset: fake.NewSimpleClientset()}
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_rules")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+
+		go func() {
+			done <- p.DumpLoop(ctx)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return mock.ExpectationsWereMet() == nil
+		}, 5*time.Second, 10*time.Millisecond, "the first dump should run once the lease is acquired")
+
+		cancel()
+
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("the others don't dump", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		assert.NoError(t, err, "Error creating mock database")
+
+		defer db.Close()
+
+		clientset := fake.NewSimpleClientset(heldLease("proxysql-satellite-1"))
+
+		// count the elector's reads of the lease, to know that it has seen the other agent holding it
+		var reads atomic.Int32
+
+		clientset.PrependReactor("get", "leases", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+			reads.Add(1)
+
+			return false, nil, nil
+		})
+
+		settings := leaderSettings(t)
+		p := &ProxySQL{conn: db, settings: settings, clientset: clientset}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+
+		go func() {
+			done <- p.DumpLoop(ctx)
+		}()
+
+		assert.Eventually(t, func() bool { return reads.Load() >= 3 }, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+
+		assert.NoError(t, <-done)
+
+		// no queries are expected, and DumpData creates a directory for its files before running any
+		entries, err := os.ReadDir(settings.Dump.OutputDir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries, "only the leader should dump")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,82 @@
+package proxysql
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// The admin password currently in use; this changes when proxysql.password_file is rotated.
+func (p *ProxySQL) password() string {
+	p.passwordMu.Lock()
+	defer p.passwordMu.Unlock()
+
+	return p.adminPassword
+}
+
+func (p *ProxySQL) setPassword(password string) {
+	p.passwordMu.Lock()
+	defer p.passwordMu.Unlock()
+
+	p.adminPassword = password
+}
+
+// WatchPasswordFile re-reads proxysql.password_file every proxysql.password_reload_interval seconds, and
+// reconnects to the admin interface with the new password when it changes. This lets the password be
+// rotated through a mounted secret without restarting the pod. It returns when the context is cancelled,
+// or straight away if there's no password file or the interval is 0.
+func (p *ProxySQL) WatchPasswordFile(ctx context.Context) {
+	file := p.settings.ProxySQL.PasswordFile
+	interval := p.settings.ProxySQL.PasswordReloadInterval
+
+	if file == "" || interval <= 0 {
+		return
+	}
+
+	slog.Info("Watching the admin password file for changes", slog.String("path", file), slog.Int("interval", interval))
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.reloadPassword(ctx); err != nil {
+				slog.Error("Unable to reload the admin password", slog.String("path", file), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Read the password file, and if the password has changed, drop the pooled connections so that new ones
+// are made with the new password. Returns true if the password changed.
+func (p *ProxySQL) reloadPassword(ctx context.Context) (bool, error) {
+	contents, err := os.ReadFile(p.settings.ProxySQL.PasswordFile)
+	if err != nil {
+		return false, err
+	}
+
+	password := strings.TrimSpace(string(contents))
+	if password == p.password() {
+		return false, nil
+	}
+
+	p.setPassword(password)
+
+	// closing the idle connections means the next query dials a fresh one, which picks up the new password.
+	// connections that are in use are closed when they're returned to the pool.
+	p.conn.SetMaxIdleConns(0)
+	p.conn.SetMaxIdleConns(p.settings.ProxySQL.MaxIdleConns)
+
+	if err := p.conn.PingContext(ctx); err != nil {
+		return true, err
+	}
+
+	slog.Info("Admin password changed, reconnected to ProxySQL admin", slog.String("path", p.settings.ProxySQL.PasswordFile))
+
+	return true, nil
+}
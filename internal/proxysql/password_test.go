@@ -0,0 +1,59 @@
+package proxysql
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+)
+
+func TestReloadPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	file := filepath.Join(t.TempDir(), "password")
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.PasswordFile = file
+
+	p := &ProxySQL{conn: db, settings: settings, adminPassword: "old"}
+
+	t.Run("unchanged", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(file, []byte("old\n"), 0o600))
+
+		changed, err := p.reloadPassword(context.Background())
+
+		assert.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, "old", p.password())
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(file, []byte("new\n"), 0o600))
+
+		// the pooled connection is dropped so that a new one is made with the new password; sqlmock can't
+		// open a second connection, so the ping afterwards fails here
+		changed, _ := p.reloadPassword(context.Background())
+
+		assert.True(t, changed)
+		assert.Equal(t, "new", p.password())
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		assert.NoError(t, os.Remove(file))
+
+		_, err := p.reloadPassword(context.Background())
+
+		assert.Error(t, err)
+		assert.Equal(t, "new", p.password())
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,134 +1,568 @@
 package proxysql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/persona-id/proxysql-agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/client-go/kubernetes"
-
-	// Import the mysql driver functionality.
-	_ "github.com/go-sql-driver/mysql"
 )
 
 type ProxySQL struct {
-	conn      *sql.DB
-	settings  *configuration.Config
-	clientset kubernetes.Interface
+	conn        *sql.DB
+	settings    *configuration.Config
+	clientset   kubernetes.Interface
+	initialized atomic.Bool // set once New has connected to proxysql
+
+	shutdownMu       sync.Mutex
+	shutdownComplete bool
+	shutdownErr      error
+	shutdownDone     chan struct{}
+
+	phaseMu     sync.Mutex
+	phase       ShutdownPhase
+	cancelDrain context.CancelFunc // stops the drain in progress, for Resume; guarded by phaseMu
+	drained     chan struct{}      // closed once the drain in progress has returned; guarded by phaseMu
+	resuming    bool               // Resume is undoing the drain, so the phase is left for it to settle; guarded by phaseMu
+
+	pauseFailed atomic.Bool
+
+	// serializes the changes the satellite and core loops make with the ones forced through /resync
+	resyncMu sync.Mutex
+
+	passwordMu    sync.Mutex
+	adminPassword string
+
+	webhooks sync.WaitGroup
+
+	probeMu       sync.Mutex
+	probeCache    *ProbeResult // the last successful probe, reused for api.probe_cache_ms
+	probeCachedAt time.Time
+
+	backendsOffline bool // the last probe found every backend offline; guarded by probeMu
+
+	uploader Uploader // set by DumpData when dump.s3.bucket is
+
+	leader atomic.Bool // this agent holds the dump.lease_name lease
 }
 
-func (p *ProxySQL) New(configs *configuration.Config) (*ProxySQL, error) {
+func (p *ProxySQL) New(ctx context.Context, configs *configuration.Config) (*ProxySQL, error) {
 	settings := configs
-	address := settings.ProxySQL.Address
-	username := settings.ProxySQL.Username
-	password := settings.ProxySQL.Password
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/", username, password, address)
+	address, err := settings.AdminAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	psql := &ProxySQL{settings: settings, shutdownDone: make(chan struct{}), adminPassword: settings.ProxySQL.Password}
+
+	cfg := mysql.NewConfig()
+	cfg.User = settings.ProxySQL.Username
+	cfg.Passwd = settings.ProxySQL.Password
+	cfg.Net = "tcp"
+	cfg.Addr = address
+	// the admin interface doesn't support prepared statements, so the placeholders are filled in client side
+	cfg.InterpolateParams = true
+
+	if tag := settings.ProxySQL.ConnectionTag; tag != "" {
+		cfg.ConnectionAttributes = "program_name:" + tag
+	}
+
+	if settings.ProxySQL.TLS.Enabled {
+		cfg.TLS, err = tlsConfig(settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// look the password up for every new connection, so that a rotated proxysql.password_file is picked up
+	err = cfg.Apply(mysql.BeforeConnect(func(_ context.Context, c *mysql.Config) error {
+		c.Passwd = psql.password()
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
 
-	conn, err := sql.Open("mysql", dsn)
+	connector, err := mysql.NewConnector(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	err = conn.Ping()
+	psql.conn = sql.OpenDB(connector)
+
+	err = psql.connect(ctx, time.Duration(settings.ProxySQL.ConnectTimeout)*time.Second)
 	if err != nil {
 		return nil, err
 	}
 
 	slog.Info("Connected to ProxySQL admin", slog.String("Host", address))
 
-	return &ProxySQL{conn, settings, nil}, nil
+	psql.conn.SetMaxOpenConns(settings.ProxySQL.MaxOpenConns)
+	psql.conn.SetMaxIdleConns(settings.ProxySQL.MaxIdleConns)
+	psql.conn.SetConnMaxLifetime(time.Duration(settings.ProxySQL.ConnMaxLifetime) * time.Second)
+
+	psql.runStartupCommands()
+
+	psql.initialized.Store(true)
+
+	return psql, nil
+}
+
+// Initialized reports whether New finished setting up the connection to proxysql. A ProxySQL that wasn't
+// created by New, or whose New failed part way through, has no admin connection to run anything on.
+func (p *ProxySQL) Initialized() bool {
+	return p != nil && p.initialized.Load()
+}
+
+// Run the admin commands from proxysql.startup_commands once, before the loops start. These are meant
+// for idempotent tuning (eg: UPDATE global_variables), so a failing command is logged rather than fatal.
+func (p *ProxySQL) runStartupCommands() {
+	for _, command := range p.settings.ProxySQL.StartupCommands {
+		result, err := p.conn.Exec(command)
+		if err != nil {
+			slog.Error("Startup command failed", slog.String("command", command), slog.Any("error", err))
+			metrics.CommandFailuresTotal.Inc()
+
+			continue
+		}
+
+		rows, _ := result.RowsAffected()
+
+		slog.Info("Ran startup command", slog.String("command", command), slog.Int64("rows_affected", rows))
+	}
 }
 
 func (p *ProxySQL) Conn() *sql.DB {
 	return p.conn
 }
 
-func (p *ProxySQL) Ping() error {
-	return p.conn.Ping()
+// Ping checks that the admin interface is reachable. Once the pod has started shutting down, it returns
+// ErrShuttingDown instead, because proxysql is paused or has been killed by then and shouldn't look healthy.
+// Like the probes, it gives proxysql a few seconds to come back if it was restarted underneath the agent.
+func (p *ProxySQL) Ping(ctx context.Context) error {
+	if p.IsShuttingDown() {
+		return ErrShuttingDown
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeReconnectTimeout)
+	defer cancel()
+
+	return p.withReconnect(ctx, func() error {
+		return p.conn.PingContext(ctx)
+	})
 }
 
-func (p *ProxySQL) GetBackends() (map[string]int, error) {
-	entries := make(map[string]int)
+// Backend is a server in runtime_mysql_servers. The same host is often in more than one hostgroup, eg: with a
+// read/write split, so a backend is only unique by its hostgroup, hostname and port together.
+type Backend struct {
+	Hostgroup      int    `json:"hostgroup"`
+	Hostname       string `json:"hostname"`
+	Port           int    `json:"port"`
+	Status         string `json:"status"`
+	Weight         int    `json:"weight"`
+	MaxConnections int    `json:"max_connections"`
+}
 
-	rows, err := p.conn.Query("SELECT hostgroup_id, hostname, port FROM runtime_mysql_servers ORDER BY hostgroup_id")
+// GetBackends returns every row of runtime_mysql_servers, which are the backends proxysql is currently using
+// along with their statuses. Like Ping, it returns ErrShuttingDown once the pod has started shutting down, since
+// proxysql may be gone by then.
+func (p *ProxySQL) GetBackends(ctx context.Context) ([]Backend, error) {
+	if p.IsShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+
+	query := "SELECT hostgroup_id, hostname, port, status, weight, max_connections FROM runtime_mysql_servers ORDER BY hostgroup_id, hostname, port"
+
+	rows, err := p.conn.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	for rows.Next() {
-		var hostgroup, port int
+	backends := []Backend{}
 
-		var hostname string
+	for rows.Next() {
+		var backend Backend
 
-		err := rows.Scan(&hostgroup, &hostname, &port)
+		err := rows.Scan(&backend.Hostgroup, &backend.Hostname, &backend.Port, &backend.Status, &backend.Weight, &backend.MaxConnections)
 		if err != nil {
 			return nil, err
 		}
 
-		entries[hostname] = hostgroup
+		backends = append(backends, backend)
+	}
+
+	return backends, rows.Err()
+}
+
+// Read every row of a proxysql admin table, keyed by column name, along with the table's columns in order.
+// The columns are discovered from the result rather than scanned positionally, so callers keep working when
+// proxysql adds columns to a table. Values are the strings proxysql returned, or nil for NULLs. If columns are
+// given, only those are selected, otherwise every column is.
+func (p *ProxySQL) queryTable(table string, columns ...string) ([]string, []map[string]any, error) {
+	selected := "*"
+	if len(columns) > 0 {
+		selected = strings.Join(columns, ", ")
+	}
 
-		if rows.Err() != nil && errors.Is(err, sql.ErrNoRows) {
-			return nil, rows.Err()
+	rows, err := p.conn.Query("SELECT " + selected + " FROM " + table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	columns, err = rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	results := []map[string]any{}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
 		}
+
+		// RawBytes are only valid until the next call to Next, so copy them out
+		row := make(map[string]any, len(columns))
+
+		for i, column := range columns {
+			if values[i] == nil {
+				row[column] = nil
+			} else {
+				row[column] = string(values[i])
+			}
+		}
+
+		results = append(results, row)
 	}
 
-	return entries, nil
+	return columns, results, rows.Err()
+}
+
+// The value of a column from queryTable as a string; missing columns and NULLs are empty.
+func columnString(row map[string]any, column string) string {
+	value, _ := row[column].(string)
+
+	return value
 }
 
 // k8s probes
 
+// How far back to look in the monitor logs when checking the monitor's health.
+const monitorWindow = time.Minute
+
+// ErrProbeTimeout is returned from RunProbes when a probe query takes longer than api.probe_timeout.
+var ErrProbeTimeout = errors.New("probe query timed out")
+
 type ProbeResult struct {
-	Status   string `json:"status,omitempty"`
-	Message  string `json:"message,omitempty"`
-	Clients  int    `json:"clients,omitempty"`
-	Draining bool   `json:"draining,omitempty"`
-	Probe    string `json:"probe,omitempty"`
-	Backends struct {
-		Total  int `json:"total,omitempty"`
-		Online int `json:"online,omitempty"`
+	Status         string `json:"status,omitempty"`
+	Message        string `json:"message,omitempty"`
+	Clients        int    `json:"clients,omitempty"`
+	Draining       bool   `json:"draining,omitempty"`
+	PauseFailed    bool   `json:"pause_failed,omitempty"` // proxysql couldn't be paused, so it accepted connections while draining
+	Probe          string `json:"probe,omitempty"`
+	VisibleCores   *int   `json:"visible_cores,omitempty"`   // only set when readiness.require_core_visible is enabled
+	MonitorHealthy *bool  `json:"monitor_healthy,omitempty"` // only set when readiness.check_monitor is enabled
+	Lagging        *bool  `json:"lagging,omitempty"`         // only set when readiness.max_lag_ms is set
+	Backends       struct {
+		Total        int `json:"total,omitempty"`
+		Online       int `json:"online,omitempty"`
+		TotalWeight  int `json:"total_weight,omitempty"`
+		OnlineWeight int `json:"online_weight,omitempty"` // capacity that's actually serving, for weighted pools
 	} `json:"backends,omitempty"`
 }
 
-func (p *ProxySQL) RunProbes() (ProbeResult, error) {
-	total, online, err := p.probeBackends()
+// RunProbes checks the health of proxysql. If proxysql has been restarted in place, the probes wait a
+// short while for it to come back rather than failing straight away.
+//
+// The kubelet hits all three probe endpoints, often at once, so a successful result is reused for
+// api.probe_cache_ms. Concurrent callers wait for the probe that's in flight rather than running their own.
+func (p *ProxySQL) RunProbes(ctx context.Context) (results ProbeResult, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "RunProbes")
+	defer func() { tracing.End(span, err) }()
+
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+
+	ttl := time.Duration(p.settings.API.ProbeCacheMS) * time.Millisecond
+
+	if p.probeCache != nil && time.Since(p.probeCachedAt) < ttl {
+		span.SetAttributes(attribute.Bool("probe.cached", true))
+
+		return *p.probeCache, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeReconnectTimeout)
+	defer cancel()
+
+	err = p.withReconnect(ctx, func() error {
+		var err error
+
+		results, err = p.runProbes(ctx)
+
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool("probe.cached", false),
+		attribute.String("probe.status", results.Status),
+		attribute.Int("backends.total", results.Backends.Total),
+		attribute.Int("backends.online", results.Backends.Online),
+		attribute.Int("clients", results.Clients),
+	)
+
+	if ttl > 0 {
+		p.probeCache = &results
+		p.probeCachedAt = time.Now()
+	}
+
+	return results, nil
+}
+
+// Drop the cached probe result, so that the next probe sees the current state.
+func (p *ProxySQL) invalidateProbeCache() {
+	p.probeMu.Lock()
+	defer p.probeMu.Unlock()
+
+	p.probeCache = nil
+}
+
+// Bound a probe query by api.probe_timeout, so that a hung admin connection fails the probe instead of hanging it.
+func (p *ProxySQL) probeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.settings.API.ProbeTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, time.Duration(p.settings.API.ProbeTimeout)*time.Second)
+}
+
+// Mark the error from a probe query whose context from probeContext ran out as a timeout. Drivers don't agree on
+// the error they return for a cancelled query, so the context is checked rather than the error.
+func probeError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrProbeTimeout, err)
+	}
+
+	return err
+}
+
+func (p *ProxySQL) runProbes(ctx context.Context) (ProbeResult, error) {
+	total, online, err := p.probeBackends(ctx)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	totalWeight, onlineWeight, err := p.probeBackendWeights(ctx)
 	if err != nil {
 		return ProbeResult{}, err
 	}
 
-	clients, err := p.ProbeClients()
+	clients, err := p.ProbeClients(ctx)
 	if err != nil {
 		return ProbeResult{}, err
 	}
 
 	results := ProbeResult{
-		Clients:  clients,
-		Draining: probeDraining(),
+		Clients:     clients,
+		Draining:    probeDraining(),
+		PauseFailed: p.pauseFailed.Load(),
 	}
 
 	results.Backends.Total = total
 	results.Backends.Online = online
+	results.Backends.TotalWeight = totalWeight
+	results.Backends.OnlineWeight = onlineWeight
+
+	if p.settings.RunMode == "satellite" && p.settings.Readiness.RequireCoreVisible {
+		cores, err := p.GetVisibleCorePods(ctx)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+
+		results.VisibleCores = &cores
+	}
+
+	if p.settings.Readiness.CheckMonitor {
+		healthy, err := p.probeMonitor(ctx)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+
+		results.MonitorHealthy = &healthy
+	}
+
+	if p.settings.Readiness.MaxLagMS > 0 {
+		lagging, err := p.ProbeReplicationLag(ctx)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+
+		results.Lagging = &lagging
+	}
 
-	return processResults(results), nil
+	results = processResults(results)
+
+	p.alertBackendsOffline(results)
+
+	if p.settings.Probes.LogProxySQLErrors && (results.Status == "unhealthy" || results.Status == "monitor_unhealthy") {
+		p.logRecentErrors()
+	}
+
+	return results, nil
 }
 
-// Process the ProbeResult and set values for use in the json message the API returns.
+// BackendError is a row from stats_mysql_errors; the errors proxysql got back from the backends, or hit while
+// connecting to them.
+type BackendError struct {
+	Hostgroup int    `json:"hostgroup"`
+	Hostname  string `json:"hostname"`
+	Port      int    `json:"port"`
+	Errno     int    `json:"errno"`
+	Count     int    `json:"count"`
+	LastSeen  int64  `json:"last_seen"`
+	LastError string `json:"last_error"`
+}
+
+// GetRecentErrors returns the backend errors that proxysql has seen since the cutoff, most recent first.
+func (p *ProxySQL) GetRecentErrors(since time.Time) ([]BackendError, error) {
+	query := fmt.Sprintf(`SELECT hostgroup, hostname, port, errno, count_star, last_seen, last_error
+			FROM stats_mysql_errors
+			WHERE last_seen >= %d
+			ORDER BY last_seen DESC
+			LIMIT 10`, since.Unix())
+
+	rows, err := p.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	errs := []BackendError{}
+
+	for rows.Next() {
+		var e BackendError
+
+		err := rows.Scan(&e.Hostgroup, &e.Hostname, &e.Port, &e.Errno, &e.Count, &e.LastSeen, &e.LastError)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, e)
+	}
+
+	return errs, rows.Err()
+}
+
+// Log the backend errors from the last monitorWindow, to give operators the likely cause of an unhealthy probe
+// without having to exec into the pod. Failing to fetch them doesn't fail the probe.
+func (p *ProxySQL) logRecentErrors() {
+	errs, err := p.GetRecentErrors(time.Now().Add(-monitorWindow))
+	if err != nil {
+		slog.Error("Unable to fetch recent proxysql errors", slog.Any("error", err))
+
+		return
+	}
+
+	for _, e := range errs {
+		slog.Warn("Recent proxysql backend error",
+			slog.Int("hostgroup", e.Hostgroup),
+			slog.String("hostname", e.Hostname),
+			slog.Int("port", e.Port),
+			slog.Int("errno", e.Errno),
+			slog.Int("count", e.Count),
+			slog.Int64("last_seen", e.LastSeen),
+			slog.String("last_error", e.LastError),
+		)
+	}
+}
+
+// The tables logged by DumpServers. runtime_mysql_servers includes the status column, so shunned and offline
+// backends show up.
+var serverTables = []string{"runtime_proxysql_servers", "proxysql_servers", "runtime_mysql_servers"} //nolint:gochecknoglobals
+
+// DumpServers logs the proxysql cluster and backend server tables, to debug the state of a running pod. Each
+// table gets a line with its row count; if log.probes is set, every row is logged as well.
+func (p *ProxySQL) DumpServers(ctx context.Context) error {
+	for _, table := range serverTables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		columns, rows, err := p.queryTable(table)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", table, err)
+		}
+
+		slog.Info("Server table", slog.String("table", table), slog.Int("rows", len(rows)))
+
+		if !p.settings.Log.Probes {
+			continue
+		}
+
+		for _, row := range rows {
+			attrs := make([]any, 0, len(columns)+1)
+			attrs = append(attrs, slog.String("table", table))
+
+			for _, column := range columns {
+				attrs = append(attrs, slog.Any(column, row[column]))
+			}
+
+			slog.Info("Server table row", attrs...)
+		}
+	}
+
+	return nil
+}
+
+// Process the ProbeResult and set values for use in the json message the API returns. A partial outage is
+// still "ok", but only once nothing more serious (eg: draining) applies.
 func processResults(results ProbeResult) ProbeResult {
 	switch {
-	case results.Backends.Online > results.Backends.Total:
-		results.Status = "ok"
-		results.Message = "some backends offline"
 	case results.Backends.Online == 0:
 		results.Status = "unhealthy"
 		results.Message = "all backends offline"
 	case results.Draining:
 		results.Status = "draining"
 		results.Message = "draining traffic"
+	case results.VisibleCores != nil && *results.VisibleCores == 0:
+		results.Status = "isolated"
+		results.Message = "no core pods visible"
+	case results.MonitorHealthy != nil && !*results.MonitorHealthy:
+		results.Status = "monitor_unhealthy"
+		results.Message = "monitor can't reach any backends"
+	case results.Lagging != nil && *results.Lagging:
+		results.Status = "lagging"
+		results.Message = "all backends are lagging"
+	case results.Backends.Online < results.Backends.Total:
+		results.Status = "ok"
+		results.Message = "some backends offline"
 	default:
 		results.Status = "ok"
 		results.Message = "all backends online"
@@ -137,33 +571,144 @@ func processResults(results ProbeResult) ProbeResult {
 	return results
 }
 
-func (p *ProxySQL) probeBackends() (int /* backends total */, int /* backends online */, error) {
+// Count the backends by status, in one round trip to the admin port rather than one per status.
+func (p *ProxySQL) probeBackends(ctx context.Context) (int /* backends total */, int /* backends online */, error) {
+	var total, online, shunned int
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	rows, err := p.conn.QueryContext(ctx, "SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")
+	if err != nil {
+		return -1, -1, probeError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			status string
+			count  int
+		)
+
+		err := rows.Scan(&status, &count)
+		if err != nil {
+			return -1, -1, probeError(ctx, err)
+		}
+
+		total += count
+
+		switch status {
+		case "ONLINE":
+			online = count
+		case "SHUNNED":
+			shunned = count
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return -1, -1, probeError(ctx, err)
+	}
+
+	metrics.Backends.WithLabelValues("total").Set(float64(total))
+	metrics.Backends.WithLabelValues("online").Set(float64(online))
+	metrics.Backends.WithLabelValues("shunned").Set(float64(shunned))
+
+	return total, online, nil
+}
+
+// Sum the weights of the backends, in total and of the ONLINE ones. In weighted pools the counts alone don't say
+// much about capacity; losing one heavily weighted backend matters more than losing a lightly weighted one.
+func (p *ProxySQL) probeBackendWeights(ctx context.Context) (int /* total weight */, int /* online weight */, error) {
 	var total, online int
 
-	err := p.conn.QueryRow("SELECT COUNT(*) FROM runtime_mysql_servers").Scan(&total)
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	query := `SELECT COALESCE(SUM(weight), 0), COALESCE(SUM(CASE WHEN status = 'ONLINE' THEN weight ELSE 0 END), 0)
+			FROM runtime_mysql_servers`
+
+	err := p.conn.QueryRowContext(ctx, query).Scan(&total, &online)
 	if err != nil {
-		return -1, -1, err
+		return -1, -1, probeError(ctx, err)
 	}
 
-	err = p.conn.QueryRow("SELECT COUNT(*) FROM runtime_mysql_servers WHERE status = 'ONLINE'").Scan(&online)
+	return total, online, nil
+}
+
+// Check the monitor module's connect and ping logs. Backends can look ONLINE in runtime_mysql_servers while the
+// monitor is actually unable to reach them, so the monitor is considered healthy if it has successfully connected
+// to or pinged at least one backend recently.
+func (p *ProxySQL) probeMonitor(ctx context.Context) (bool, error) {
+	var reachable int
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	cutoff := time.Now().Add(-monitorWindow).UnixMicro()
+
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM (
+			SELECT hostname, port FROM monitor.mysql_server_connect_log WHERE time_start_us > %[1]d AND connect_error IS NULL
+			UNION
+			SELECT hostname, port FROM monitor.mysql_server_ping_log WHERE time_start_us > %[1]d AND ping_error IS NULL
+		)`, cutoff)
+
+	err := p.conn.QueryRowContext(ctx, query).Scan(&reachable)
 	if err != nil {
-		return -1, -1, err
+		return false, probeError(ctx, err)
+	}
+
+	if reachable == 0 {
+		slog.Warn("ProxySQL monitor hasn't reached any backends recently", slog.Duration("window", monitorWindow))
 	}
 
-	return online, total, nil
+	return reachable > 0, nil
 }
 
-func (p *ProxySQL) ProbeClients() (int /* clients connected */, error) {
+// ProbeReplicationLag reports whether every ONLINE backend is lagging by more than readiness.max_lag_ms, going by
+// the latest check in the monitor's replication lag log. repl_lag is Seconds_Behind_Master; backends that the
+// monitor doesn't check the lag of have no log entries, and don't count as lagging.
+func (p *ProxySQL) ProbeReplicationLag(ctx context.Context) (bool, error) {
+	var online, lagging int
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT COUNT(*), COALESCE(SUM(CASE WHEN (
+				SELECT l.repl_lag FROM monitor.mysql_server_replication_lag_log l
+				WHERE l.hostname = s.hostname AND l.port = s.port
+				ORDER BY l.time_start_us DESC LIMIT 1
+			) * 1000 > %d THEN 1 ELSE 0 END), 0)
+			FROM runtime_mysql_servers s WHERE s.status = 'ONLINE'`, p.settings.Readiness.MaxLagMS)
+
+	err := p.conn.QueryRowContext(ctx, query).Scan(&online, &lagging)
+	if err != nil {
+		return false, probeError(ctx, err)
+	}
+
+	if online > 0 && lagging == online {
+		slog.Warn("All online backends are lagging", slog.Int("backends", online), slog.Int("max_lag_ms", p.settings.Readiness.MaxLagMS))
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (p *ProxySQL) ProbeClients(ctx context.Context) (int /* clients connected */, error) {
 	var online sql.NullInt32
 
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
 	// this one doesnt appear to do what we want
 	// query := "SELECT Client_Connections_connected FROM mysql_connections ORDER BY timestamp DESC LIMIT 1"
 
 	query := "select sum(ConnUsed) from stats_mysql_connection_pool"
 
-	err := p.conn.QueryRow(query).Scan(&online)
+	err := p.conn.QueryRowContext(ctx, query).Scan(&online)
 	if err != nil {
-		return -1, err
+		return -1, probeError(ctx, err)
 	}
 
 	if online.Valid {
@@ -176,10 +721,7 @@ func (p *ProxySQL) ProbeClients() (int /* clients connected */, error) {
 // if the file /var/lib/proxysql/draining exists, we're in maint mode or draining traffic
 // for a shutdown, and should return unhealthy.
 func probeDraining() bool {
-	// FIXME: make this configurable?
-	filename := "/var/lib/proxysql/draining"
-
-	_, err := os.Stat(filename)
+	_, err := os.Stat(drainFile)
 
 	switch {
 	case os.IsNotExist(err):
@@ -1,41 +1,44 @@
 package proxysql
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gopkg.in/DATA-DOG/go-sqlmock.v2"
 )
 
 //nolint:gochecknoglobals
-var tmpConfig = &configuration.Config{
-	StartDelay: 0,
-	Log: struct {
-		Level  string `mapstructure:"level"`
-		Format string `mapstructure:"format"`
-	}{},
-	ProxySQL: struct {
-		Address  string `mapstructure:"address"`
-		Username string `mapstructure:"username"`
-		Password string `mapstructure:"password"`
-	}{},
-	RunMode: "",
-	Core: struct {
-		Interval    int `mapstructure:"interval"`
-		PodSelector struct {
-			Namespace string `mapstructure:"namespace"`
-			App       string `mapstructure:"app"`
-			Component string `mapstructure:"component"`
-		} "mapstructure:\"podselector\""
-	}{},
-	Satellite: struct {
-		Interval int `mapstructure:"interval"`
-	}{},
-	Interfaces: []string{},
-}
+var tmpConfig = func() *configuration.Config {
+	settings := &configuration.Config{
+		Interfaces: []string{},
+	}
+
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.Satellite.LastCheckMS = 30000
+	settings.Satellite.CoreHostname = "proxysql-core"
+
+	return settings
+}()
 
 func TestPing(t *testing.T) {
 	db, mock, err := sqlmock.New()
@@ -46,12 +49,20 @@ func TestPing(t *testing.T) {
 	// FIXME: this doesn't exist now apparently, idk.
 	// mock.ExpectPing()
 
-	proxy := &ProxySQL{db, tmpConfig, nil}
-	err = proxy.Ping()
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+	err = proxy.Ping(context.Background())
 
 	assert.NoError(t, err, "Ping() should not return an error")
 	assert.NotNil(t, proxy.conn, "Conn should not return nil")
 	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+
+	t.Run("shutting down", func(t *testing.T) {
+		proxy.phase = PhaseDraining
+
+		err := proxy.Ping(context.Background())
+
+		assert.ErrorIs(t, err, ErrShuttingDown)
+	})
 }
 
 func TestGetBackends(t *testing.T) {
@@ -60,21 +71,29 @@ func TestGetBackends(t *testing.T) {
 
 	defer db.Close()
 
-	proxy := &ProxySQL{db, tmpConfig, nil}
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	query := regexp.QuoteMeta("SELECT hostgroup_id, hostname, port, status, weight, max_connections FROM runtime_mysql_servers ORDER BY hostgroup_id, hostname, port")
 
 	t.Run("no error", func(t *testing.T) {
-		expectedRows := sqlmock.NewRows([]string{"hostgroup_id", "hostname", "port"}).
-			AddRow(1, "host1", 3306).
-			AddRow(2, "host2", 3306).
-			AddRow(1, "host3", 3307)
+		// host1 is in both hostgroups, as it would be with a read/write split
+		expectedRows := sqlmock.NewRows([]string{"hostgroup_id", "hostname", "port", "status", "weight", "max_connections"}).
+			AddRow(1, "host1", 3306, "ONLINE", 1000, 1000).
+			AddRow(1, "host3", 3307, "SHUNNED", 1, 500).
+			AddRow(2, "host1", 3306, "ONLINE", 1000, 1000).
+			AddRow(2, "host2", 3306, "OFFLINE_SOFT", 1, 500)
 
-		mock.ExpectQuery("SELECT hostgroup_id, hostname, port FROM runtime_mysql_servers ORDER BY hostgroup_id").
-			WillReturnRows(expectedRows)
+		mock.ExpectQuery(query).WillReturnRows(expectedRows)
 
-		entries, err := proxy.GetBackends()
+		entries, err := proxy.GetBackends(context.Background())
 		assert.NoError(t, err, "GetBackends should not return an error")
 
-		expectedEntries := map[string]int{"host1": 1, "host2": 2, "host3": 1}
+		expectedEntries := []Backend{
+			{Hostgroup: 1, Hostname: "host1", Port: 3306, Status: "ONLINE", Weight: 1000, MaxConnections: 1000},
+			{Hostgroup: 1, Hostname: "host3", Port: 3307, Status: "SHUNNED", Weight: 1, MaxConnections: 500},
+			{Hostgroup: 2, Hostname: "host1", Port: 3306, Status: "ONLINE", Weight: 1000, MaxConnections: 1000},
+			{Hostgroup: 2, Hostname: "host2", Port: 3306, Status: "OFFLINE_SOFT", Weight: 1, MaxConnections: 500},
+		}
 
 		assert.Equal(t, expectedEntries, entries, "Entries should match the expected values")
 		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
@@ -82,12 +101,842 @@ func TestGetBackends(t *testing.T) {
 
 	t.Run("returns error", func(t *testing.T) {
 		expectedError := errors.New("database error")
-		mock.ExpectQuery("SELECT hostgroup_id, hostname, port FROM runtime_mysql_servers ORDER BY hostgroup_id").
-			WillReturnError(expectedError)
+		mock.ExpectQuery(query).WillReturnError(expectedError)
 
-		_, err = proxy.GetBackends()
+		_, err = proxy.GetBackends(context.Background())
 
 		assert.EqualError(t, err, expectedError.Error(), "GetBackends should return the expected error")
 		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
 	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		// no queries are run once the pod is shutting down
+		proxy.phase = PhaseDraining
+
+		_, err = proxy.GetBackends(context.Background())
+
+		assert.ErrorIs(t, err, ErrShuttingDown)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+}
+
+func TestQueryTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	// a column this version of the agent doesn't know about, and a NULL
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_query_rules")).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "hits", "new_column"}).
+			AddRow(1, 100, "x").
+			AddRow(2, 200, nil))
+
+	columns, rows, err := proxy.queryTable("stats_mysql_query_rules")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rule_id", "hits", "new_column"}, columns)
+	assert.Equal(t, []map[string]any{
+		{"rule_id": "1", "hits": "100", "new_column": "x"},
+		{"rule_id": "2", "hits": "200", "new_column": nil},
+	}, rows)
+	assert.Equal(t, "", columnString(rows[1], "new_column"))
+	assert.Equal(t, "", columnString(rows[1], "missing_column"))
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestRunStartupCommands(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(true)
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.StartupCommands = []string{
+		"UPDATE global_variables SET variable_value = 'true' WHERE variable_name = 'admin-web_enabled'",
+		"LOAD ADMIN VARIABLES TO RUNTIME",
+		"LOAD MYSQL VARIABLES TO RUNTIME",
+	}
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectExec(regexp.QuoteMeta(settings.ProxySQL.StartupCommands[0])).WillReturnResult(sqlmock.NewResult(0, 1))
+	// a failing command is logged, and the rest still run
+	mock.ExpectExec(settings.ProxySQL.StartupCommands[1]).WillReturnError(errors.New("database error"))
+	mock.ExpectExec(settings.ProxySQL.StartupCommands[2]).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	proxy.runStartupCommands()
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestRunProbesRequireCoreVisible(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{RunMode: "satellite"}
+	settings.Readiness.RequireCoreVisible = true
+	settings.Satellite.LastCheckMS = 30000
+	settings.Satellite.CoreHostname = "proxysql-core"
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	expectProbes := func(visibleCores int) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+			WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("ONLINE", 3))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+			WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(3, 3))
+		mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(10))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms <= ? AND hostname != 'proxysql-core'")).
+			WithArgs(30000).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(visibleCores))
+	}
+
+	t.Run("cores visible", func(t *testing.T) {
+		expectProbes(2)
+
+		results, err := proxy.RunProbes(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", results.Status)
+		assert.Equal(t, 2, *results.VisibleCores)
+		assert.InDelta(t, 3, testutil.ToFloat64(metrics.Backends.WithLabelValues("online")), 0)
+		assert.InDelta(t, 0, testutil.ToFloat64(metrics.Backends.WithLabelValues("shunned")), 0)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("no cores visible", func(t *testing.T) {
+		expectProbes(0)
+
+		results, err := proxy.RunProbes(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "isolated", results.Status)
+		assert.Equal(t, 0, *results.VisibleCores)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+}
+
+func TestRunProbesCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.API.ProbeCacheMS = 60000
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	expectProbes := func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+			WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("ONLINE", 3))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+			WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(3, 3))
+		mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(10))
+	}
+
+	// only one set of queries is expected, so any probe that didn't reuse the result fails on an unexpected query
+	expectProbes()
+
+	var wg sync.WaitGroup
+
+	for range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			results, err := proxy.RunProbes(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, 10, results.Clients)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+
+	// starting the shutdown drops the cached result
+	proxy.setShutdownPhase(PhaseDraining)
+
+	expectProbes()
+
+	_, err = proxy.RunProbes(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet(), "the probes should run again once the shutdown has started")
+}
+
+func TestRunProbesSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	defer otel.SetTracerProvider(previous)
+
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillReturnError(errors.New("database error"))
+
+	_, err = proxy.RunProbes(context.Background())
+	assert.Error(t, err)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "RunProbes", spans[0].Name())
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+	}
+}
+
+func TestProbeBackends(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	query := regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")
+
+	t.Run("tallies the statuses", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).
+			AddRow("ONLINE", 4).
+			AddRow("SHUNNED", 2).
+			AddRow("OFFLINE_SOFT", 1))
+
+		total, online, err := proxy.probeBackends(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 7, total)
+		assert.Equal(t, 4, online)
+		assert.InDelta(t, 7, testutil.ToFloat64(metrics.Backends.WithLabelValues("total")), 0)
+		assert.InDelta(t, 4, testutil.ToFloat64(metrics.Backends.WithLabelValues("online")), 0)
+		assert.InDelta(t, 2, testutil.ToFloat64(metrics.Backends.WithLabelValues("shunned")), 0)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("no backends", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"status", "count"}))
+
+		total, online, err := proxy.probeBackends(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 0, total)
+		assert.Equal(t, 0, online)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("returns error", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnError(errors.New("database error"))
+
+		total, online, err := proxy.probeBackends(context.Background())
+
+		assert.EqualError(t, err, "database error")
+		assert.Equal(t, -1, total)
+		assert.Equal(t, -1, online)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+}
+
+func TestProcessResults(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		total    int
+		online   int
+		draining bool
+		status   string
+		message  string
+	}{
+		{"some backends offline", 3, 2, false, "ok", "some backends offline"},
+		{"all backends offline", 3, 0, false, "unhealthy", "all backends offline"},
+		{"all backends online", 3, 3, false, "ok", "all backends online"},
+		{"draining with some backends offline", 3, 2, true, "draining", "draining traffic"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			results := ProbeResult{Draining: tt.draining}
+			results.Backends.Total = tt.total
+			results.Backends.Online = tt.online
+
+			results = processResults(results)
+
+			assert.Equal(t, tt.status, results.Status)
+			assert.Equal(t, tt.message, results.Message)
+		})
+	}
+}
+
+func TestRunProbesAllOffline(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("SHUNNED", 3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(3, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+
+	results, err := proxy.RunProbes(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, results.Backends.Total)
+	assert.Equal(t, 0, results.Backends.Online)
+	assert.Equal(t, "unhealthy", results.Status)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestRunProbesTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.API.ProbeTimeout = 1
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	// a hung admin connection
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("ONLINE", 3))
+
+	start := time.Now()
+
+	_, err = proxy.RunProbes(context.Background())
+
+	assert.ErrorIs(t, err, ErrProbeTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second, "the probe should give up after api.probe_timeout")
+}
+
+func TestRunProbesPauseFailed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+	proxy.pauseFailed.Store(true)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("ONLINE", 3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(3, 3))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(10))
+
+	results, err := proxy.RunProbes(context.Background())
+
+	assert.NoError(t, err)
+	assert.True(t, results.PauseFailed)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestProbeMonitor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	query := `SELECT COUNT\(\*\) FROM \( SELECT hostname, port FROM monitor.mysql_server_connect_log WHERE time_start_us > \d+ AND connect_error IS NULL UNION SELECT hostname, port FROM monitor.mysql_server_ping_log WHERE time_start_us > \d+ AND ping_error IS NULL \)`
+
+	t.Run("backends reachable", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+		healthy, err := proxy.probeMonitor(context.Background())
+
+		assert.NoError(t, err)
+		assert.True(t, healthy)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("no backends reachable", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		healthy, err := proxy.probeMonitor(context.Background())
+
+		assert.NoError(t, err)
+		assert.False(t, healthy)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("returns error", func(t *testing.T) {
+		expectedError := errors.New("database error")
+		mock.ExpectQuery(query).WillReturnError(expectedError)
+
+		_, err := proxy.probeMonitor(context.Background())
+
+		assert.EqualError(t, err, expectedError.Error())
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("unhealthy monitor status", func(t *testing.T) {
+		healthy := false
+
+		results := ProbeResult{MonitorHealthy: &healthy}
+		results.Backends.Total = 2
+		results.Backends.Online = 2
+
+		results = processResults(results)
+
+		assert.Equal(t, "monitor_unhealthy", results.Status)
+	})
+}
+
+func TestProbeReplicationLag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Readiness.MaxLagMS = 5000
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	query := `SELECT COUNT\(\*\), COALESCE\(SUM\(CASE WHEN \((?s:.*)\) \* 1000 > 5000 THEN 1`
+
+	for _, tt := range []struct {
+		name    string
+		online  int
+		lagging int
+		want    bool
+	}{
+		{"none lagging", 3, 0, false},
+		{"some lagging", 3, 2, false},
+		{"all lagging", 3, 3, true},
+		{"no online backends", 0, 0, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectQuery(query).
+				WillReturnRows(sqlmock.NewRows([]string{"online", "lagging"}).AddRow(tt.online, tt.lagging))
+
+			lagging, err := proxy.ProbeReplicationLag(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, lagging)
+			assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+		})
+	}
+
+	t.Run("lagging status", func(t *testing.T) {
+		lagging := true
+
+		results := ProbeResult{Lagging: &lagging}
+		results.Backends.Total = 2
+		results.Backends.Online = 2
+
+		results = processResults(results)
+
+		assert.Equal(t, "lagging", results.Status)
+	})
+}
+
+func TestRunProbesReconnect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	// the first attempt fails because proxysql restarted, and the retry after reconnecting succeeds
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).WillReturnError(refused)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "count"}).AddRow("ONLINE", 3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(3, 3))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(10))
+
+	results, err := proxy.RunProbes(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", results.Status)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestPingReconnect(t *testing.T) {
+	// proxysql restarted, so the first dial is refused and the next one succeeds
+	connector := &restartingConnector{err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	err := proxy.Ping(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), connector.attempts.Load())
+}
+
+func TestConnect(t *testing.T) {
+	// nothing listens on port 1, so every attempt is refused
+	db, err := sql.Open("mysql", "agent:agent@tcp(127.0.0.1:1)/")
+	assert.NoError(t, err)
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	t.Run("retries until the timeout", func(t *testing.T) {
+		start := time.Now()
+
+		err := proxy.connect(context.Background(), time.Second)
+
+		assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.ErrorContains(t, err, "after 2 attempts")
+		assert.GreaterOrEqual(t, time.Since(start), reconnectInitialBackoff)
+	})
+
+	t.Run("tries once without a timeout", func(t *testing.T) {
+		err := proxy.connect(context.Background(), 0)
+
+		assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.ErrorContains(t, err, "after 1 attempts")
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		start := time.Now()
+
+		err := proxy.connect(ctx, time.Minute)
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Less(t, time.Since(start), reconnectInitialBackoff*2, "shouldn't wait out the backoff")
+	})
+
+	t.Run("fails fast on bad credentials", func(t *testing.T) {
+		connector := &failingConnector{err: &mysql.MySQLError{Number: errAccessDenied, Message: "ProxySQL Admin Error: Access denied for user 'agent'"}}
+
+		db := sql.OpenDB(connector)
+		defer db.Close()
+
+		proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+		err := proxy.connect(context.Background(), time.Minute)
+
+		assert.ErrorContains(t, err, "Access denied")
+		assert.Equal(t, int32(1), connector.attempts.Load(), "shouldn't retry")
+	})
+}
+
+// A connector that always fails to connect with err, counting the attempts.
+type failingConnector struct {
+	err      error
+	attempts atomic.Int32
+}
+
+func (c *failingConnector) Connect(context.Context) (driver.Conn, error) {
+	c.attempts.Add(1)
+
+	return nil, c.err
+}
+
+func (c *failingConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+// Refuses the first connection, then connects; the connections can only be pinged.
+type restartingConnector struct {
+	err      error
+	attempts atomic.Int32
+}
+
+func (c *restartingConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.attempts.Add(1) == 1 {
+		return nil, c.err
+	}
+
+	return pingOnlyConn{}, nil
+}
+
+func (c *restartingConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+type pingOnlyConn struct{}
+
+func (pingOnlyConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (pingOnlyConn) Close() error                        { return nil }
+func (pingOnlyConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+// Like sqlmock.New, but a query or command that wasn't expected fails the test. sqlmock only returns an error to
+// the caller for those, which the loops log and carry on from, so ExpectationsWereMet alone doesn't catch them.
+func newStrictMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.NewWithDSN(t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+
+	db := sql.OpenDB(&strictConnector{t: t, dsn: t.Name(), driver: mockDB.Driver()})
+
+	t.Cleanup(func() {
+		db.Close()
+		mockDB.Close()
+	})
+
+	return db, mock
+}
+
+// The errors sqlmock returns for a call that wasn't expected, or one that doesn't match the next expectation.
+//
+//nolint:gochecknoglobals
+var unexpectedCall = regexp.MustCompile(`was not expected|does not match|do not match`)
+
+type strictConnector struct {
+	t      *testing.T
+	dsn    string
+	driver driver.Driver
+}
+
+func (c *strictConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &strictConn{Conn: conn, t: c.t}, nil
+}
+
+func (c *strictConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type strictConn struct {
+	driver.Conn
+
+	t *testing.T
+}
+
+func (c *strictConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil && unexpectedCall.MatchString(err.Error()) {
+		c.t.Errorf("Unexpected query: %v", err)
+	}
+
+	return rows, err
+}
+
+func (c *strictConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != nil && unexpectedCall.MatchString(err.Error()) {
+		c.t.Errorf("Unexpected command: %v", err)
+	}
+
+	return result, err
+}
+
+func TestKeepalive(t *testing.T) {
+	// nothing listens on port 1, so every ping fails
+	db, err := sql.Open("mysql", "agent:agent@tcp(127.0.0.1:1)/")
+	assert.NoError(t, err)
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.KeepaliveInterval = 1
+
+	t.Run("disabled", func(_ *testing.T) {
+		// returns straight away rather than blocking until the context is cancelled
+		proxy := &ProxySQL{conn: db, settings: &configuration.Config{}}
+		proxy.Keepalive(context.Background())
+	})
+
+	t.Run("counts failed pings", func(t *testing.T) {
+		proxy := &ProxySQL{conn: db, settings: settings}
+		before := testutil.ToFloat64(metrics.KeepaliveFailuresTotal)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func() {
+			proxy.Keepalive(ctx)
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(metrics.KeepaliveFailuresTotal) > before
+		}, 5*time.Second, 10*time.Millisecond, "the failed ping should be counted")
+
+		cancel()
+		<-done
+	})
+
+	t.Run("skipped while shutting down", func(t *testing.T) {
+		proxy := &ProxySQL{conn: db, settings: settings, phase: PhaseDraining}
+		before := testutil.ToFloat64(metrics.KeepaliveFailuresTotal)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		defer cancel()
+
+		proxy.Keepalive(ctx)
+
+		assert.InDelta(t, before, testutil.ToFloat64(metrics.KeepaliveFailuresTotal), 0, "no pings while draining")
+	})
+}
+
+func TestWithReconnectShuttingDown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig, phase: PhaseStopping}
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	calls := 0
+
+	err = proxy.withReconnect(context.Background(), func() error {
+		calls++
+
+		return refused
+	})
+
+	// proxysql was killed on purpose, so there's no reconnecting and no retry
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Equal(t, 1, calls)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestProbeBackendWeights(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	// one heavily weighted backend is offline
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0), COALESCE(SUM(CASE WHEN status = 'ONLINE' THEN weight ELSE 0 END), 0) FROM runtime_mysql_servers")).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(1200, 200))
+
+	total, online, err := proxy.probeBackendWeights(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1200, total)
+	assert.Equal(t, 200, online)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestRunProbesLogErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Probes.LogProxySQLErrors = true
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	// every backend is offline, so the probe is unhealthy and the recent errors are fetched
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, COUNT(*) FROM runtime_mysql_servers GROUP BY status")).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "count"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(SUM(weight), 0)")).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "online"}).AddRow(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT hostgroup, hostname, port, errno, count_star, last_seen, last_error FROM stats_mysql_errors")).
+		WillReturnRows(sqlmock.NewRows([]string{"hostgroup", "hostname", "port", "errno", "count_star", "last_seen", "last_error"}).
+			AddRow(1, "primary", 3306, 1045, 12, 1700000000, "Access denied for user 'app'"))
+
+	results, err := proxy.RunProbes(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, "unhealthy", results.Status)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestGetRecentErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
+
+	since := time.Unix(1700000000, 0)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM stats_mysql_errors WHERE last_seen >= 1700000000 ORDER BY last_seen DESC LIMIT 10")).
+		WillReturnRows(sqlmock.NewRows([]string{"hostgroup", "hostname", "port", "errno", "count_star", "last_seen", "last_error"}).
+			AddRow(1, "primary", 3306, 1045, 12, 1700000060, "Access denied for user 'app'").
+			AddRow(2, "replica", 3306, 2003, 3, 1700000030, "Can't connect to MySQL server"))
+
+	errs, err := proxy.GetRecentErrors(since)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []BackendError{
+		{Hostgroup: 1, Hostname: "primary", Port: 3306, Errno: 1045, Count: 12, LastSeen: 1700000060, LastError: "Access denied for user 'app'"},
+		{Hostgroup: 2, Hostname: "replica", Port: 3306, Errno: 2003, Count: 3, LastSeen: 1700000030, LastError: "Can't connect to MySQL server"},
+	}, errs)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestDumpServers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Log.Probes = true
+
+	proxy := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM runtime_proxysql_servers")).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname", "port", "weight", "comment"}).
+			AddRow("10.0.0.1", 6032, 0, "proxysql-core-0"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM proxysql_servers")).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname", "port", "weight", "comment"}).
+			AddRow("10.0.0.1", 6032, 0, "proxysql-core-0"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM runtime_mysql_servers")).
+		WillReturnRows(sqlmock.NewRows([]string{"hostgroup_id", "hostname", "port", "status"}).
+			AddRow(1, "primary", 3306, "ONLINE").
+			AddRow(2, "replica", 3306, "SHUNNED"))
+
+	assert.NoError(t, proxy.DumpServers(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+
+	t.Run("query error", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM runtime_proxysql_servers")).
+			WillReturnError(errors.New("admin interface unavailable"))
+
+		err := proxy.DumpServers(context.Background())
+
+		assert.ErrorContains(t, err, "unable to read runtime_proxysql_servers")
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
 }
@@ -0,0 +1,167 @@
+package proxysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+)
+
+const (
+	// Backoff between attempts to reach the admin interface after losing the connection.
+	reconnectInitialBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff     = 10 * time.Second
+
+	// How long a probe waits for proxysql to come back before giving up.
+	probeReconnectTimeout = 5 * time.Second
+
+	// ER_ACCESS_DENIED_ERROR, for a bad admin username or password.
+	errAccessDenied = 1045
+)
+
+// Errors that mean proxysql went away underneath us, such as when it's restarted in place, rather than
+// a problem with the query itself.
+func isConnectionError(err error) bool {
+	return isConnectionClosed(err) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// Wait for the admin interface to accept connections again. database/sql throws away dead connections and
+// dials new ones on its own, so this pings with backoff until that succeeds or the context is done.
+func (p *ProxySQL) reconnect(ctx context.Context) error {
+	backoff := reconnectInitialBackoff
+
+	for {
+		err := p.conn.PingContext(ctx)
+		if err == nil {
+			slog.Info("Reconnected to ProxySQL admin")
+
+			return nil
+		}
+
+		slog.Warn("Unable to reach ProxySQL admin, retrying", slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// The admin interface rejected the credentials, so retrying won't help.
+func isAuthError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errAccessDenied
+}
+
+// Make the first connection to the admin interface, pinging with backoff for up to proxysql.connect_timeout.
+// proxysql can take a few seconds to start listening when the pod boots, so a refused connection at startup
+// isn't fatal until the timeout is up; with no timeout, there's a single attempt. Bad credentials fail straight
+// away, and so does cancelling the context, eg: when the pod is killed while it's still starting up.
+func (p *ProxySQL) connect(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	backoff := reconnectInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := p.conn.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if isAuthError(err) {
+			return fmt.Errorf("unable to connect to ProxySQL admin: %w", err)
+		}
+
+		if deadline, ok := ctx.Deadline(); timeout <= 0 || !ok || time.Until(deadline) < backoff {
+			return fmt.Errorf("unable to connect to ProxySQL admin after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("Unable to connect to ProxySQL admin, retrying",
+			slog.Int("attempt", attempt), slog.Duration("backoff", backoff), slog.Any("error", err))
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return fmt.Errorf("unable to connect to ProxySQL admin after %d attempts: %w", attempt, errors.Join(ctx.Err(), err))
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// Run fn, and if it failed because the connection to proxysql was lost, reconnect and run it once more. Once
+// the pod is shutting down proxysql is expected to go away, so there's no waiting around for it to come back.
+// Ping, the probes and the satellite resync all go through this.
+func (p *ProxySQL) withReconnect(ctx context.Context, fn func() error) error {
+	err := fn()
+	if err == nil || !isConnectionError(err) || p.IsShuttingDown() {
+		return err
+	}
+
+	slog.Warn("Lost the connection to ProxySQL admin, reconnecting", slog.Any("error", err))
+
+	if rerr := p.reconnect(ctx); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+
+	return fn()
+}
+
+// Keepalive pings the admin interface every proxysql.keepalive_interval seconds, so that a connection proxysql
+// dropped while the agent was idle is found and replaced by the ping rather than by the next probe. A failed ping
+// is logged and counted, and tried again on the next tick. The pings are skipped once the pod is shutting down,
+// as proxysql is expected to go away then. It returns when the context is cancelled, or straight away if the
+// interval is 0.
+func (p *ProxySQL) Keepalive(ctx context.Context) {
+	interval := time.Duration(p.settings.ProxySQL.KeepaliveInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	slog.Info("Keeping the admin connection alive", slog.Duration("interval", interval))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.IsShuttingDown() {
+				continue
+			}
+
+			if err := p.ping(ctx, interval); err != nil {
+				slog.Warn("Keepalive ping of ProxySQL admin failed", slog.Any("error", err))
+				metrics.KeepaliveFailuresTotal.Inc()
+			}
+		}
+	}
+}
+
+// Ping the admin interface, giving up after the timeout so that a hung ping doesn't hold up the next one.
+func (p *ProxySQL) ping(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return p.conn.PingContext(ctx)
+}
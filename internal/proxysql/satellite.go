@@ -1,43 +1,208 @@
 package proxysql
 
 import (
+	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/persona-id/proxysql-agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
 )
 
+// ErrUnexpectedComponent is returned from DumpData when dump.expect_component doesn't match the pod.
+var ErrUnexpectedComponent = errors.New("pod has an unexpected component label")
+
+// ErrOutputDirNotWritable is returned from DumpData when dump.output_dir can't be created or written to.
+var ErrOutputDirNotWritable = errors.New("dump output directory is not writable")
+
+// ErrInvalidTableName is returned from DumpTable for table names that aren't safe to put in a query.
+var ErrInvalidTableName = errors.New("invalid table name")
+
+// ErrUnknownTable is returned from DumpTable when proxysql has no table by that name, eg: a typo in dump.tables.
+var ErrUnknownTable = errors.New("unknown table")
+
+// ErrDumpIncomplete is returned from DumpData, along with the dumps that did work, when a table couldn't be
+// dumped or uploaded.
+var ErrDumpIncomplete = errors.New("dump incomplete")
+
 //
 // Satellite mode specific functions
 //
 
-func (p *ProxySQL) Satellite() {
+// How long to wait after a core pod is added or deleted before resyncing, so that a burst of changes (eg: a
+// rolling restart) only causes one resync, and a new core pod has a moment to start proxysql.
+var coreChangeSettleTime = 5 * time.Second //nolint:gochecknoglobals
+
+// How long to wait for the core pod informer to sync before giving up on it.
+const coreWatchSyncTimeout = 30 * time.Second
+
+// Satellite runs the resync loop until the context is cancelled, at which point the pod is gracefully
+// shut down, or until the shutdown is triggered by the preStop hook. The shutdown result is returned.
+//
+// When running in k8s, the core pods are also watched, and proxysql_servers is reloaded shortly after one is
+// added or deleted, rather than waiting for the resync to notice that a core has gone missing.
+func (p *ProxySQL) Satellite(ctx context.Context) error {
 	interval := p.settings.Satellite.Interval
 
 	slog.Info("Satellite mode initialized, looping", slog.Int("interval", interval))
 
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	changes, stopWatching := p.watchCorePods(ctx)
+	defer stopWatching()
+
+	// set while waiting for a burst of core pod changes to settle
+	var settled <-chan time.Time
+
+	// the first resync runs straight away rather than on the first tick, so that a new pod converges at startup
+	p.runResync(ctx, interval, p.SatelliteResync)
+
 	for {
-		err := p.SatelliteResync()
-		if err != nil {
-			slog.Error("Error running resync", slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			slog.Info("Satellite loop stopping, starting graceful shutdown")
+
+			return p.gracefulShutdown(context.WithoutCancel(ctx))
+		case <-p.Done():
+			return p.shutdownErr
+		case <-ticker.C:
+			p.runResync(ctx, interval, p.SatelliteResync)
+		case <-changes:
+			settled = time.After(coreChangeSettleTime)
+		case <-settled:
+			settled = nil
+
+			slog.Info("Core pods changed, reloading proxysql servers")
+			p.runResync(ctx, interval, p.reloadProxySQLServers)
 		}
+	}
+}
+
+// Run one of the resync functions, unless the pod is shutting down; resyncing reloads proxysql_servers, which
+// has no business happening on a pod that's draining.
+func (p *ProxySQL) runResync(ctx context.Context, interval int, resync func() error) {
+	if p.IsShuttingDown() {
+		return
+	}
+
+	// if proxysql was restarted in place, wait for it to come back, but not past the next tick
+	resyncCtx, cancel := context.WithTimeout(ctx, time.Duration(interval)*time.Second)
+	defer cancel()
+
+	p.resyncMu.Lock()
+	defer p.resyncMu.Unlock()
 
-		time.Sleep(time.Duration(interval) * time.Second)
+	if err := p.withReconnect(resyncCtx, resync); err != nil {
+		slog.Error("Error running resync", slog.Any("error", err))
 	}
 }
 
+// Watch the core pods, and signal on the returned channel when one is added or deleted. The returned function
+// stops the informer. Outside of k8s there's nothing to watch, so the channel is nil and the satellite only
+// polls; the same goes for when the context is cancelled before the informer has synced.
+func (p *ProxySQL) watchCorePods(ctx context.Context) (<-chan struct{}, func()) {
+	if err := p.setupClientset(); err != nil {
+		slog.Info("Not watching the core pods, falling back to polling", slog.Any("error", err))
+
+		return nil, func() {}
+	}
+
+	selector := labels.Set(map[string]string{
+		"app":       p.settings.Core.PodSelector.App,
+		"component": p.settings.Core.PodSelector.Component,
+	}).AsSelector()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		p.clientset,
+		0,
+		informers.WithNamespace(p.settings.Core.PodSelector.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector.String()
+		}),
+	)
+
+	changes := make(chan struct{}, 1)
+
+	// a pending signal already covers any further changes
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	informer := factory.Core().V1().Pods().Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(_ any, isInInitialList bool) {
+			// the pods that already exist are covered by the first resync
+			if !isInInitialList {
+				notify()
+			}
+		},
+		DeleteFunc: func(_ any) {
+			notify()
+		},
+	})
+	if err != nil {
+		slog.Error("Unable to watch the core pods, falling back to polling", slog.Any("error", err))
+
+		return nil, func() {}
+	}
+
+	stopper := make(chan struct{})
+	stop := func() {
+		close(stopper)
+		factory.Shutdown()
+	}
+
+	factory.Start(stopper)
+
+	// don't hold up the satellite loop indefinitely if the API server is unreachable, or past a shutdown
+	syncCtx, cancel := context.WithTimeout(ctx, coreWatchSyncTimeout)
+	defer cancel()
+
+	if !cache.WaitForCacheSync(syncCtx.Done(), informer.HasSynced) {
+		if ctx.Err() == nil {
+			slog.Error("Timed out syncing the core pods, falling back to polling")
+		}
+
+		stop()
+
+		return nil, func() {}
+	}
+
+	return changes, stop
+}
+
+// Count the core pods that this satellite hasn't heard from within satellite.last_check_ms. The default entry
+// for the core service, satellite.core_hostname, isn't a pod so it's left out.
 func (p *ProxySQL) GetMissingCorePods() (int, error) {
 	count := -1
 
+	// the hostname is a free-form setting, so it's quoted with sqlString rather than bound to a placeholder
 	query := `SELECT COUNT(hostname)
 			FROM stats_proxysql_servers_metrics
-			WHERE last_check_ms > 30000
-			AND hostname != 'proxysql-core'
+			WHERE last_check_ms > ?
+			AND hostname != ` + sqlString(p.settings.Satellite.CoreHostname) + `
 			AND Uptime_s > 0`
-	row := p.conn.QueryRow(query)
+	row := p.conn.QueryRow(query, p.settings.Satellite.LastCheckMS)
 
 	err := row.Scan(&count)
 	if err != nil {
@@ -47,61 +212,424 @@ func (p *ProxySQL) GetMissingCorePods() (int, error) {
 	return count, nil
 }
 
-func (p *ProxySQL) SatelliteResync() error {
+// Count the core pods that this satellite can currently see; a satellite that can't see any cores
+// can't receive configuration from the cluster.
+func (p *ProxySQL) GetVisibleCorePods(ctx context.Context) (int, error) {
+	count := -1
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	query := `SELECT COUNT(hostname)
+			FROM stats_proxysql_servers_metrics
+			WHERE last_check_ms <= ?
+			AND hostname != ` + sqlString(p.settings.Satellite.CoreHostname) + `
+			AND Uptime_s > 0`
+	row := p.conn.QueryRowContext(ctx, query, p.settings.Satellite.LastCheckMS)
+
+	err := row.Scan(&count)
+	if err != nil {
+		return count, probeError(ctx, err)
+	}
+
+	return count, nil
+}
+
+func (p *ProxySQL) SatelliteResync() (err error) {
+	_, span := tracing.Tracer().Start(context.Background(), "SatelliteResync")
+	defer func() { tracing.End(span, err) }()
+
 	missing, err := p.GetMissingCorePods()
 	if err != nil {
 		return err
 	}
 
+	span.SetAttributes(attribute.Int("missing_cores", missing))
+
 	if missing > 0 {
 		slog.Info("Resyncing pod to cluster", slog.Int("missing_cores", missing))
 
-		commands := []string{
-			"DELETE FROM proxysql_servers",
-			"LOAD PROXYSQL SERVERS FROM CONFIG",
-			"LOAD PROXYSQL SERVERS TO RUNTIME;",
+		return p.reloadProxySQLServers()
+	}
+
+	return nil
+}
+
+// Reload proxysql_servers from the config file, which points at the core service, so that the cluster sync
+// fetches the current list of core pods again.
+func (p *ProxySQL) reloadProxySQLServers() error {
+	for _, command := range reloadServersCommands {
+		_, err := p.conn.Exec(command)
+		if err != nil {
+			metrics.CommandFailuresTotal.Inc()
+
+			return err
 		}
+	}
+
+	metrics.ResyncsTotal.Inc()
+
+	return nil
+}
+
+var reloadServersCommands = []string{ //nolint:gochecknoglobals
+	"DELETE FROM proxysql_servers",
+	"LOAD PROXYSQL SERVERS FROM CONFIG",
+	"LOAD PROXYSQL SERVERS TO RUNTIME;",
+}
+
+// ForceResync resyncs straight away, for use during incidents, rather than waiting for the loops. Satellites
+// reload proxysql_servers whether or not any cores look missing, and core pods load their config to runtime,
+// which pushes it out to the rest of the cluster. It waits for a resync or cluster change that's already running
+// to finish first, so that their commands don't interleave. It returns the commands that were run, including the
+// one that failed, if any.
+func (p *ProxySQL) ForceResync(ctx context.Context) (ran []string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ForceResync")
+	defer func() { tracing.End(span, err) }()
+
+	if p.IsShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+
+	p.resyncMu.Lock()
+	defer p.resyncMu.Unlock()
+
+	commands := loadToRuntimeCommands
+	if p.settings.RunMode == "satellite" {
+		commands = reloadServersCommands
+	}
+
+	for _, command := range commands {
+		ran = append(ran, command)
 
-		for _, command := range commands {
-			_, err := p.conn.Exec(command)
-			if err != nil {
+		_, err := p.conn.ExecContext(ctx, command)
+		if err != nil {
+			slog.Error("Command failed", slog.String("command", command), slog.Any("error", err))
+			metrics.CommandFailuresTotal.Inc()
+
+			return ran, err
+		}
+	}
+
+	metrics.ResyncsTotal.Inc()
+
+	slog.Info("Forced a resync", slog.String("run_mode", p.settings.RunMode), slog.Int("commands", len(ran)))
+
+	return ran, nil
+}
+
+// data we eventually want to load into snowflake; which of these are dumped is set by dump.tables
+//  1. query_digest: stats_mysql_query_digests (read from the _reset variant when dump.reset.digests is set)
+//  2. query_rules: mysql_query_rules
+//  3. query_rule_stats: stats_mysql_query_rules
+//  4. any other admin or stats table, by its name
+//
+// The files are written to a new subdirectory of dump.output_dir for each run, eg: /tmp/XXXX/Y.csv. Files that
+// were uploaded have been removed by the time DumpData returns, so where each dump ended up is returned: the S3
+// object or snowflake stage it was uploaded to, or the local file. A table that can't be dumped or uploaded
+// doesn't stop the others, but ErrDumpIncomplete is returned along with them.
+func (p *ProxySQL) DumpData(ctx context.Context) ([]string, error) {
+	if expected := p.settings.Dump.ExpectComponent; expected != "" {
+		if err := p.checkComponent(ctx, expected); err != nil {
+			slog.Error("Refusing to dump data", slog.Any("error", err))
+			return nil, err
+		}
+	}
+
+	tmpdir, err := dumpDir(p.settings.Dump.OutputDir)
+	if err != nil {
+		slog.Error("Refusing to dump data", slog.Any("error", err))
+		return nil, err
+	}
+
+	if p.s3Enabled() && p.uploader == nil {
+		uploader, err := newS3Uploader(ctx, p.settings.Dump.S3.Bucket, p.settings.Dump.S3.Region)
+		if err != nil {
+			slog.Error("Refusing to dump data", slog.Any("error", err))
+			return nil, err
+		}
+
+		p.uploader = uploader
+	}
+
+	files := []string{}
+
+	var errs []error
+
+	upload := func(table string, file string) {
+		location, err := p.uploadDump(ctx, table, file)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		files = append(files, location)
+	}
+
+	for _, table := range p.settings.Dump.Tables {
+		tableFile, err := p.dumpEntry(tmpdir, table)
+
+		switch {
+		case errors.Is(err, ErrInvalidTableName), errors.Is(err, ErrUnknownTable):
+			slog.Warn("Skipping unknown dump table", slog.String("table", table), slog.Any("error", err))
+		case err != nil:
+			slog.Error("Error dumping table", slog.String("table", table), slog.Any("error", err))
+
+			errs = append(errs, fmt.Errorf("unable to dump %s: %w", table, err))
+		case tableFile != "":
+			slog.Info("Saved table to file", slog.String("table", table), slog.String("filename", tableFile))
+
+			upload(table, tableFile)
+		}
+	}
+
+	if p.settings.Dump.IncludeConnPool {
+		connPoolFile, err := p.DumpConnectionPoolStats(ctx, tmpdir)
+		if err != nil {
+			slog.Error("Error in DumpConnectionPoolStats()", slog.Any("error", err))
+
+			errs = append(errs, fmt.Errorf("unable to dump the connection pool stats: %w", err))
+		} else if connPoolFile != "" {
+			slog.Info("Saved mysql connection pool stats to file", slog.String("filename", connPoolFile))
+
+			upload("conn_pool", connPoolFile)
+		}
+	}
+
+	if len(errs) > 0 {
+		return files, fmt.Errorf("%w: %w", ErrDumpIncomplete, errors.Join(errs...))
+	}
+
+	return files, nil
+}
+
+// DumpLoop runs DumpData every dump.interval seconds until the context is cancelled. A failed dump is logged
+// and tried again on the next tick, except when the pod has the wrong component label, which won't change.
+// With dump.leader_election set, only the agent holding the lease dumps; the others skip their ticks.
+func (p *ProxySQL) DumpLoop(ctx context.Context) error {
+	interval := p.settings.Dump.Interval
+
+	if p.settings.Dump.LeaderElection {
+		if err := p.setupClientset(); err != nil {
+			return err
+		}
+
+		elected, err := p.startLeaderElection(ctx)
+		if err != nil {
+			return err
+		}
+
+		// otherwise the first dump is always skipped, as the election hasn't finished yet
+		select {
+		case <-ctx.Done():
+			slog.Info("Dump loop stopping before the leader was elected")
+
+			return nil
+		case <-elected:
+		}
+	}
+
+	slog.Info("Dump mode initialized, looping", slog.Int("interval", interval))
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	// like the satellite loop, the first dump runs straight away rather than on the first tick
+	for {
+		switch {
+		case p.IsShuttingDown():
+		case !p.IsLeader():
+			slog.Debug("Not the leader, skipping the dump", slog.String("lease", p.settings.Dump.LeaseName))
+		default:
+			if _, err := p.DumpData(ctx); errors.Is(err, ErrUnexpectedComponent) {
 				return err
+			} else if err != nil {
+				slog.Error("Error running dump", slog.Any("error", err))
 			}
 		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Dump loop stopping")
+
+			return nil
+		case <-ticker.C:
+		}
 	}
+}
 
-	return nil
+// Run the dump for a dump.tables entry. The built-in dumps are selected by name, and anything else is dumped
+// as-is with DumpTable.
+func (p *ProxySQL) dumpEntry(tmpdir string, table string) (string, error) {
+	switch table {
+	case "query_digest":
+		return p.DumpQueryDigests(tmpdir)
+	case "query_rules":
+		return p.DumpQueryRules(tmpdir)
+	case "query_rule_stats":
+		return p.DumpQueryRuleStats(tmpdir)
+	default:
+		return p.DumpTable(tmpdir, table)
+	}
 }
 
-// data we eventually want to load into snowflake
-//  1. stats_mysql_query_digests (maybe use _reset to reset the state)
-//  2. mysql_query_rules
-//  3. stats_mysql_query_rules
-//
-// FIXME: all these functions dump to /tmp/XXXX/Y.csv; we want the directory to be configurable at least.
-func (p *ProxySQL) DumpData() {
-	tmpdir, _ := os.MkdirTemp("/tmp", "")
+// Create the directory for this run's dump files, as a new subdirectory of outputDir, creating outputDir first if
+// it doesn't exist.
+func dumpDir(outputDir string) (string, error) {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrOutputDirNotWritable, err)
+	}
+
+	dir, err := os.MkdirTemp(outputDir, "")
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrOutputDirNotWritable, err)
+	}
+
+	return dir, nil
+}
+
+// dumpWriter is a CSV writer for a dump file, which is gzipped when dump.compress is set.
+type dumpWriter struct {
+	*csv.Writer
+
+	name   string
+	file   *os.File
+	gz     *gzip.Writer
+	closed bool
+}
+
+// Create <tmpdir>/<hostname>-<suffix>.csv, or .csv.gz when dump.compress is set.
+func (p *ProxySQL) createDumpFile(tmpdir string, hostname string, suffix string) (*dumpWriter, error) {
+	name := fmt.Sprintf("%s/%s-%s.csv", tmpdir, hostname, suffix)
+	if p.settings.Dump.Compress {
+		name += ".gz"
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
 
-	digestsFile, err := p.DumpQueryDigests(tmpdir)
+	writer := &dumpWriter{name: name, file: file}
+
+	if p.settings.Dump.Compress {
+		writer.gz = gzip.NewWriter(file)
+		writer.Writer = csv.NewWriter(writer.gz)
+	} else {
+		writer.Writer = csv.NewWriter(file)
+	}
+
+	return writer, nil
+}
+
+// Name returns the path of the dump file.
+func (w *dumpWriter) Name() string {
+	return w.name
+}
+
+// Close flushes the CSV writer, then the gzip stream, and then closes the file; in that order, otherwise the
+// end of the file is lost. It's safe to call more than once, so that it can also be deferred.
+func (w *dumpWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	w.Flush()
+
+	err := w.Error()
+
+	if w.gz != nil {
+		err = errors.Join(err, w.gz.Close())
+	}
+
+	return errors.Join(err, w.file.Close())
+}
+
+// Dump an arbitrary admin or stats table to CSV, with whatever columns proxysql returns for it. The table
+// name is checked against the same pattern as dump.tables, since it can't be passed as a query parameter.
+func (p *ProxySQL) DumpTable(tmpdir string, table string) (string, error) {
+	if !configuration.ValidTableName(table) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidTableName, table)
+	}
+
+	columns, rows, err := p.queryTable(table)
 	if err != nil {
-		slog.Error("Error in DumpQueryDigests()", slog.Any("error", err))
-	} else if digestsFile != "" {
-		slog.Info("Saved mysql query digests to file", slog.String("filename", digestsFile))
+		// the admin interface is backed by sqlite, which reports a missing table as "no such table: <name>"
+		if strings.Contains(err.Error(), "no such table") {
+			return "", fmt.Errorf("%w: %w", ErrUnknownTable, err)
+		}
+
+		return "", err
+	}
+
+	// Don't write out empty files
+	if len(rows) == 0 {
+		slog.Debug("No rows in table, not proceeding with DumpTable()", slog.String("table", table))
+
+		return "", nil
 	}
 
-	rulesFile, err := p.DumpQueryRules(tmpdir)
+	hostname, err := os.Hostname()
 	if err != nil {
-		slog.Error("Error in DumpQueryRules()", slog.Any("error", err))
-	} else if rulesFile != "" {
-		slog.Info("Saved mysql query rules to file", slog.String("filename", rulesFile))
+		// os.Hostname didn't work for some reason, so try to get the hostname from the ENV
+		hostname = os.Getenv("HOSTNAME")
+		if hostname == "" {
+			// that didn't work either, so something is really wrong
+			return "", err
+		}
 	}
 
-	rulesStatsFile, err := p.DumpQueryRuleStats(tmpdir)
+	writer, err := p.createDumpFile(tmpdir, hostname, table)
 	if err != nil {
-		slog.Error("Error in DumpQueryRuleStats()", slog.Any("error", err))
-	} else if rulesStatsFile != "" {
-		slog.Info("Saved mysql query rules stats to file", slog.String("filename", rulesStatsFile))
+		return "", err
+	}
+
+	defer writer.Close()
+
+	if err := writer.Write(append([]string{"pod_name"}, columns...)); err != nil {
+		return "", err
 	}
+
+	for _, row := range rows {
+		values := []string{hostname}
+
+		for _, column := range columns {
+			values = append(values, columnString(row, column))
+		}
+
+		if err := writer.Write(values); err != nil {
+			return "", err
+		}
+	}
+
+	return writer.Name(), writer.Close()
+}
+
+// Make sure the pod we're running in has the expected component label, so that a dump CronJob scheduled
+// against the wrong pods (eg: core instead of satellite) doesn't export stats that analysts don't expect.
+func (p *ProxySQL) checkComponent(ctx context.Context, expected string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	if err := p.setupClientset(); err != nil {
+		return fmt.Errorf("unable to check the pod's component label: %w", err)
+	}
+
+	namespace := p.settings.Core.PodSelector.Namespace
+
+	pod, err := p.clientset.CoreV1().Pods(namespace).Get(ctx, hostname, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to check the pod's component label: %w", err)
+	}
+
+	if component := pod.Labels["component"]; component != expected {
+		return fmt.Errorf("%w: pod %s is a %q pod, dump.expect_component is %q", ErrUnexpectedComponent, hostname, component, expected)
+	}
+
+	return nil
 }
 
 // ProxySQL docs: https://proxysql.com/documentation/stats-statistics/#stats_mysql_query_digest
@@ -130,84 +658,97 @@ func (p *ProxySQL) DumpQueryDigests(tmpdir string) (string, error) {
 		}
 	}
 
-	dumpFile := fmt.Sprintf("%s/%s-digests.csv", tmpdir, hostname)
-
-	file, err := os.Create(dumpFile)
+	writer, err := p.createDumpFile(tmpdir, hostname, "digests")
 	if err != nil {
 		return "", err
 	}
 
-	defer file.Close()
+	defer writer.Close()
+
+	// the columns to dump, and the header to use for each. sum_time, min_time and max_time are all in microseconds.
+	columns := [][2]string{
+		{"hostgroup", "hostgroup"},
+		{"schemaname", "schemaname"},
+		{"username", "username"},
+		{"client_address", "client_address"},
+		{"digest", "digest"},
+		{"digest_text", "digest_text"},
+		{"count_star", "count_star"},
+		{"first_seen", "first_seen"},
+		{"last_seen", "last_seen"},
+		{"sum_time", "sum_time_us"},
+		{"min_time", "min_time_us"},
+		{"max_time", "max_time_us"},
+		{"sum_rows_affected", "sum_rows_affected"},
+		{"sum_rows_sent", "sum_rows_sent"},
+	}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	if !p.settings.Dump.IncludeClientAddress {
+		columns = slices.DeleteFunc(columns, func(column [2]string) bool { return column[0] == "client_address" })
+	}
 
-	header := []string{
-		"pod_name",
-		"hostgroup",
-		"schemaname",
-		"username",
-		"digest",
-		"digest_text",
-		"count_star",
-		"first_seen",
-		"last_seen",
-		"sum_time_us",
-		"min_time_us",
-		"max_time",
-		"sum_rows_affected",
-		"sum_rows_sent",
+	header := []string{"pod_name"}
+	for _, column := range columns {
+		header = append(header, column[1])
 	}
 
 	if err := writer.Write(header); err != nil {
 		return "", err
 	}
 
-	rows, err := p.conn.Query("SELECT * FROM stats_mysql_query_digest")
+	// reading from the _reset variant zeroes the digests once they've been exported. the count above has to use
+	// the plain table, otherwise it would reset them before they were dumped.
+	table := "stats_mysql_query_digest"
+	if p.settings.Dump.Reset.Digests {
+		table = "stats_mysql_query_digest_reset"
+	}
+
+	selected := make([]string, 0, len(columns))
+	for _, column := range columns {
+		selected = append(selected, column[0])
+	}
+
+	_, rows, err := p.queryTable(table, selected...)
 	if err != nil {
 		return "", err
 	}
 
-	defer rows.Close()
-
-	for rows.Next() {
-		var hostgroup int
+	for _, row := range rows {
+		values := []string{hostname}
 
-		var schemaname, username, clientAddress, digest, digestText string
+		for _, column := range columns {
+			value := columnString(row, column[0])
 
-		var countStar, firstSeen, lastSeen, sumTime, minTime, maxTime, sumRowsAffected, sumRowsSent int
+			// proxysql reports these as unix timestamps
+			if column[0] == "first_seen" || column[0] == "last_seen" {
+				if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+					value = formatTimestamp(seconds, p.settings.Dump.TimeFormat)
+				}
+			}
 
-		err := rows.Scan(&hostgroup, &schemaname, &username, &clientAddress, &digest, &digestText, &countStar,
-			&firstSeen, &lastSeen, &sumTime, &minTime, &maxTime, &sumRowsAffected, &sumRowsSent)
-		if err != nil {
-			return "", err
+			values = append(values, value)
 		}
 
-		// Create a slice with the values
-		values := []string{
-			hostname,
-			strconv.Itoa(hostgroup),
-			schemaname,
-			username,
-			digest,
-			`"` + digestText + `"`, // Quote the digest_text field to handle commas
-			strconv.Itoa(countStar),
-			time.Unix(int64(firstSeen), 0).String(),
-			time.Unix(int64(lastSeen), 0).String(),
-			strconv.Itoa(sumTime),
-			strconv.Itoa(minTime),
-			strconv.Itoa(maxTime),
-			strconv.Itoa(sumRowsAffected),
-			strconv.Itoa(sumRowsSent),
-		}
-
-		// Write the values to the CSV file
+		// digest_text often contains commas, quotes and newlines, which the csv writer quotes and escapes
 		if err := writer.Write(values); err != nil {
 			return "", err
 		}
 	}
 
-	return dumpFile, nil
+	return writer.Name(), writer.Close()
+}
+
+// Render a unix timestamp from proxysql for the dump files, according to dump.time_format; either "unix",
+// "rfc3339", or a Go time layout. Times are always in UTC so that they're consistent across pods.
+func formatTimestamp(seconds int64, format string) string {
+	switch format {
+	case "unix":
+		return strconv.FormatInt(seconds, 10)
+	case "", "rfc3339":
+		return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+	default:
+		return time.Unix(seconds, 0).UTC().Format(format)
+	}
 }
 
 // ProxySQL docs: https://proxysql.com/documentation/main-runtime/#mysql_query_rules
@@ -236,17 +777,12 @@ func (p *ProxySQL) DumpQueryRules(tmpdir string) (string, error) {
 		}
 	}
 
-	dumpFile := fmt.Sprintf("%s/%s-rules.csv", tmpdir, hostname)
-
-	file, err := os.Create(dumpFile)
+	writer, err := p.createDumpFile(tmpdir, hostname, "rules")
 	if err != nil {
 		return "", err
 	}
 
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	defer writer.Close()
 
 	header := []string{
 		"rule_id",
@@ -359,7 +895,12 @@ func (p *ProxySQL) DumpQueryRules(tmpdir string) (string, error) {
 		}
 	}
 
-	return dumpFile, nil
+	// a driver error part way through ends the loop early, and would otherwise leave a truncated file
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("unable to read mysql_query_rules: %w", err)
+	}
+
+	return writer.Name(), writer.Close()
 }
 
 // ProxySQL docs: https://proxysql.com/documentation/stats-statistics/#stats_mysql_query_rules
@@ -388,16 +929,12 @@ func (p *ProxySQL) DumpQueryRuleStats(tmpdir string) (string, error) {
 		}
 	}
 
-	dumpFile := fmt.Sprintf("%s/%s-rule-stats.csv", tmpdir, hostname)
-
-	file, err := os.Create(dumpFile)
+	writer, err := p.createDumpFile(tmpdir, hostname, "rule-stats")
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	defer writer.Close()
 
 	header := []string{"rule_id", "hits"}
 
@@ -430,5 +967,102 @@ func (p *ProxySQL) DumpQueryRuleStats(tmpdir string) (string, error) {
 		}
 	}
 
-	return dumpFile, nil
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("unable to read stats_mysql_query_rules: %w", err)
+	}
+
+	return writer.Name(), writer.Close()
+}
+
+// ProxySQL docs: https://proxysql.com/documentation/stats-statistics/#stats_mysql_connection_pool
+func (p *ProxySQL) DumpConnectionPoolStats(ctx context.Context, tmpdir string) (string, error) {
+	var rowCount int
+
+	err := p.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM stats_mysql_connection_pool").Scan(&rowCount)
+	if err != nil {
+		return "", err
+	}
+
+	// Don't proceed with this function if there are no backends in the pool
+	if rowCount <= 0 {
+		slog.Debug("No connection pool stats, not proceeding with DumpConnectionPoolStats()")
+
+		return "", nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		// os.Hostname didn't work for some reason, so try to get the hostname from the ENV
+		hostname = os.Getenv("HOSTNAME")
+		if hostname == "" {
+			// that didn't work either, so something is really wrong
+			return "", err
+		}
+	}
+
+	writer, err := p.createDumpFile(tmpdir, hostname, "conn-pool")
+	if err != nil {
+		return "", err
+	}
+
+	defer writer.Close()
+
+	header := []string{
+		"pod_name",
+		"hostgroup",
+		"srv_host",
+		"srv_port",
+		"status",
+		"ConnUsed",
+		"ConnFree",
+		"ConnOK",
+		"ConnERR",
+		"Queries",
+	}
+
+	if err := writer.Write(header); err != nil {
+		return "", err
+	}
+
+	rows, err := p.conn.QueryContext(ctx,
+		"SELECT hostgroup, srv_host, srv_port, status, ConnUsed, ConnFree, ConnOK, ConnERR, Queries FROM stats_mysql_connection_pool")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hostgroup, srvPort, connUsed, connFree, connOK, connERR, queries int
+
+		var srvHost, status string
+
+		err := rows.Scan(&hostgroup, &srvHost, &srvPort, &status, &connUsed, &connFree, &connOK, &connERR, &queries)
+		if err != nil {
+			return "", err
+		}
+
+		// Create a slice with the values
+		values := []string{
+			hostname,
+			strconv.Itoa(hostgroup),
+			srvHost,
+			strconv.Itoa(srvPort),
+			status,
+			strconv.Itoa(connUsed),
+			strconv.Itoa(connFree),
+			strconv.Itoa(connOK),
+			strconv.Itoa(connERR),
+			strconv.Itoa(queries),
+		}
+
+		if err := writer.Write(values); err != nil {
+			return "", err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("unable to read stats_mysql_connection_pool: %w", err)
+	}
+
+	return writer.Name(), writer.Close()
 }
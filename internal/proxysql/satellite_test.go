@@ -2,14 +2,26 @@ package proxysql
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"errors"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/persona-id/proxysql-agent/internal/configuration"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestGetMissingCorePods(t *testing.T) {
@@ -18,13 +30,13 @@ func TestGetMissingCorePods(t *testing.T) {
 
 	defer db.Close()
 
-	query := regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms > 30000 AND hostname != 'proxysql-core' AND Uptime_s > 0")
+	query := regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms > ? AND hostname != 'proxysql-core' AND Uptime_s > 0")
 
-	proxy := &ProxySQL{db, tmpConfig, nil}
+	proxy := &ProxySQL{conn: db, settings: tmpConfig}
 
 	t.Run("no error", func(t *testing.T) {
 		expectedCount := 1
-		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(expectedCount))
+		mock.ExpectQuery(query).WithArgs(30000).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(expectedCount))
 
 		count, err := proxy.GetMissingCorePods()
 		assert.NoError(t, err, "GetMissingCorePods should not return an error")
@@ -33,6 +45,23 @@ func TestGetMissingCorePods(t *testing.T) {
 		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
 	})
 
+	t.Run("quoted hostname", func(t *testing.T) {
+		settings := *tmpConfig
+		settings.Satellite.CoreHostname = `proxysql-core' OR '1'='1\`
+
+		proxy := &ProxySQL{conn: db, settings: &settings}
+
+		// the quotes are doubled, and the backslash isn't an escape in SQLite
+		mock.ExpectQuery(regexp.QuoteMeta(`AND hostname != 'proxysql-core'' OR ''1''=''1\' AND Uptime_s > 0`)).
+			WithArgs(30000).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		_, err := proxy.GetMissingCorePods()
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
 	t.Run("returns error", func(t *testing.T) {
 		expectedError := errors.New("database error")
 		mock.ExpectQuery(query).WillReturnError(expectedError)
@@ -55,10 +84,14 @@ func TestSatelliteResync(t *testing.T) {
 
 	mock.MatchExpectationsInOrder(true)
 
-	p := &ProxySQL{conn: db}
+	settings := &configuration.Config{}
+	settings.Satellite.LastCheckMS = 60000
+	settings.Satellite.CoreHostname = "proxysql-core-svc"
+
+	p := &ProxySQL{conn: db, settings: settings}
 
-	query := regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms > 30000 AND hostname != 'proxysql-core' AND Uptime_s > 0")
-	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	query := regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms > ? AND hostname != 'proxysql-core-svc' AND Uptime_s > 0")
+	mock.ExpectQuery(query).WithArgs(60000).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
 
 	commands := []string{
 		"DELETE FROM proxysql_servers",
@@ -79,6 +112,299 @@ func TestSatelliteResync(t *testing.T) {
 	}
 }
 
+func TestForceResync(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	t.Run("satellite", func(t *testing.T) {
+		for _, command := range reloadServersCommands {
+			mock.ExpectExec(regexp.QuoteMeta(command)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		ran, err := p.ForceResync(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, reloadServersCommands, ran)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("core", func(t *testing.T) {
+		settings.RunMode = "core"
+		defer func() { settings.RunMode = "satellite" }()
+
+		for _, command := range loadToRuntimeCommands {
+			mock.ExpectExec(command).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		ran, err := p.ForceResync(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, loadToRuntimeCommands, ran)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("command fails", func(t *testing.T) {
+		mock.ExpectExec("DELETE FROM proxysql_servers").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("LOAD PROXYSQL SERVERS FROM CONFIG").WillReturnError(errors.New("database error"))
+
+		ran, err := p.ForceResync(context.Background())
+
+		assert.EqualError(t, err, "database error")
+		assert.Equal(t, []string{"DELETE FROM proxysql_servers", "LOAD PROXYSQL SERVERS FROM CONFIG"}, ran)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		p.phase = PhaseDraining
+		defer func() { p.phase = PhaseRunning }()
+
+		ran, err := p.ForceResync(context.Background())
+
+		assert.ErrorIs(t, err, ErrShuttingDown)
+		assert.Empty(t, ran)
+		assert.NoError(t, mock.ExpectationsWereMet(), "nothing should run while shutting down")
+	})
+
+	t.Run("waits for the satellite loop", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		resynced := make(chan struct{})
+
+		go func() {
+			defer close(resynced)
+
+			p.runResync(context.Background(), 60, func() error {
+				close(started)
+				<-release
+
+				return nil
+			})
+		}()
+
+		<-started
+
+		for _, command := range reloadServersCommands {
+			mock.ExpectExec(regexp.QuoteMeta(command)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		forced := make(chan error)
+
+		go func() {
+			_, err := p.ForceResync(context.Background())
+			forced <- err
+		}()
+
+		assert.Never(t, func() bool {
+			return mock.ExpectationsWereMet() == nil
+		}, 100*time.Millisecond, 10*time.Millisecond, "the forced resync shouldn't run alongside the loop's")
+
+		close(release)
+		<-resynced
+
+		assert.NoError(t, <-forced)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestSatelliteInitialResync(t *testing.T) {
+	settings := &configuration.Config{RunMode: "satellite"}
+	settings.Satellite.Interval = 3600 // long enough that the ticker never fires during the test
+
+	tests := []struct {
+		name   string
+		phase  ShutdownPhase
+		resync bool
+	}{
+		{name: "resyncs before the first tick", phase: PhaseRunning, resync: true},
+		{name: "skipped while shutting down", phase: PhaseDraining, resync: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newStrictMock(t)
+
+			p := &ProxySQL{conn: db, settings: settings, shutdownDone: make(chan struct{}), phase: tt.phase}
+
+			if tt.resync {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(hostname) FROM stats_proxysql_servers_metrics WHERE last_check_ms > ?")).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			}
+
+			done := make(chan error)
+
+			go func() {
+				done <- p.Satellite(context.Background())
+			}()
+
+			// the resync runs before the loop checks for the end of the shutdown, so a resync while shutting down
+			// would still fail the test after this
+			assert.Eventually(t, func() bool {
+				return mock.ExpectationsWereMet() == nil
+			}, 5*time.Second, 10*time.Millisecond, "the first resync should run at startup")
+
+			close(p.shutdownDone)
+
+			assert.NoError(t, <-done)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWatchCorePods(t *testing.T) {
+	settings := &configuration.Config{}
+	settings.Core.PodSelector.Namespace = "proxysql"
+	settings.Core.PodSelector.App = "proxysql"
+	settings.Core.PodSelector.Component = "core"
+
+	corePod := func(name string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "proxysql",
+				Labels:    map[string]string{"app": "proxysql", "component": "core"},
+			},
+		}
+	}
+
+	// already running when the satellite starts, so it's covered by the first resync
+	clientset := fake.NewSimpleClientset(corePod("proxysql-core-0"))
+
+	p := &ProxySQL{settings: settings, clientset: clientset}
+
+	changes, stop := p.watchCorePods(context.Background())
+	defer stop()
+
+	assert.NotNil(t, changes)
+	assert.Never(t, func() bool { return len(changes) > 0 }, 100*time.Millisecond, 10*time.Millisecond,
+		"the existing pods shouldn't count as changes")
+
+	// same labels, different namespace
+	other := corePod("proxysql-core-0")
+	other.Namespace = "other"
+
+	_, err := clientset.CoreV1().Pods("other").Create(context.Background(), other, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.Never(t, func() bool { return len(changes) > 0 }, 100*time.Millisecond, 10*time.Millisecond,
+		"core pods in other namespaces shouldn't count as changes")
+
+	_, err = clientset.CoreV1().Pods("proxysql").Create(context.Background(), corePod("proxysql-core-1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(changes) > 0 }, 5*time.Second, 10*time.Millisecond,
+		"a new core pod should be a change")
+	<-changes
+
+	err = clientset.CoreV1().Pods("proxysql").Delete(context.Background(), "proxysql-core-0", metav1.DeleteOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(changes) > 0 }, 5*time.Second, 10*time.Millisecond,
+		"a deleted core pod should be a change")
+}
+
+func TestWatchCorePodsCancelled(t *testing.T) {
+	settings := &configuration.Config{}
+	settings.Core.PodSelector.Namespace = "proxysql"
+
+	// the pods can never be listed, so the informer never syncs
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "pods", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		<-unblock
+
+		return false, nil, nil
+	})
+
+	p := &ProxySQL{settings: settings, clientset: clientset}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	changes, stop := p.watchCorePods(ctx)
+	stop()
+
+	assert.Nil(t, changes)
+	assert.Less(t, time.Since(start), coreWatchSyncTimeout, "shouldn't wait out the sync timeout once cancelled")
+}
+
+func TestWatchCorePodsOutOfCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBECONFIG", "")
+
+	p := &ProxySQL{settings: &configuration.Config{}}
+
+	// without a clientset or the in-cluster config, there's nothing to watch
+	changes, stop := p.watchCorePods(context.Background())
+	stop()
+
+	assert.Nil(t, changes)
+}
+
+func TestDumpLoop(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase ShutdownPhase
+		dump  bool
+	}{
+		{name: "dumps before the first tick", phase: PhaseRunning, dump: true},
+		{name: "skipped while shutting down", phase: PhaseDraining, dump: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := &configuration.Config{}
+			settings.Dump.Interval = 3600 // long enough that the ticker never fires during the test
+			settings.Dump.Tables = []string{"query_rule_stats"}
+			settings.Dump.OutputDir = t.TempDir()
+
+			db, mock := newStrictMock(t)
+
+			p := &ProxySQL{conn: db, settings: settings, phase: tt.phase}
+
+			if tt.dump {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_rules")).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+
+			go func() {
+				done <- p.DumpLoop(ctx)
+			}()
+
+			// the first dump runs before the loop checks for cancellation, so a dump while shutting down would
+			// still fail the test after this
+			assert.Eventually(t, func() bool {
+				return mock.ExpectationsWereMet() == nil
+			}, 5*time.Second, 10*time.Millisecond, "the first dump should run at startup")
+
+			cancel()
+
+			assert.NoError(t, <-done)
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			// a dump with a cancelled context fails before it queries anything, but not before it creates its
+			// directory
+			if !tt.dump {
+				entries, err := os.ReadDir(settings.Dump.OutputDir)
+				assert.NoError(t, err)
+				assert.Empty(t, entries, "no dump should run while shutting down")
+			}
+		})
+	}
+}
+
 func TestDumpQueryRuleStats(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -88,7 +414,7 @@ func TestDumpQueryRuleStats(t *testing.T) {
 
 	tmpdir := os.TempDir()
 
-	p := &ProxySQL{conn: db}
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
 
 	// No stats in table, nothing is done.
 	t.Run("no stats", func(t *testing.T) {
@@ -159,3 +485,573 @@ func TestDumpQueryRuleStats(t *testing.T) {
 		}
 	})
 }
+
+func TestDumpCompressed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Dump.Compress = true
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_rules")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_query_rules")).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "hits"}).AddRow(1, 100).AddRow(2, 200))
+
+	filePath, err := p.DumpQueryRuleStats(t.TempDir())
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(filePath, "-rule-stats.csv.gz"), filePath)
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+
+	records, err := csv.NewReader(gz).ReadAll()
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"rule_id", "hits"}, {"1", "100"}, {"2", "200"}}, records)
+}
+
+func TestDumpRowError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
+
+	// the driver fails on the second row, after the first one has been written
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_rules")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_query_rules")).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "hits"}).
+			AddRow(1, 100).
+			AddRow(2, 200).
+			RowError(1, errors.New("connection reset by peer")))
+
+	filePath, err := p.DumpQueryRuleStats(t.TempDir())
+
+	assert.ErrorContains(t, err, "connection reset by peer")
+	assert.Empty(t, filePath, "a partial dump shouldn't be returned")
+	assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+}
+
+func TestDumpConnectionPoolStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tmpdir := t.TempDir()
+
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
+
+	t.Run("no stats", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"count"}).AddRow(0)
+		mock.ExpectQuery(
+			regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_connection_pool"),
+		).WillReturnRows(rows)
+
+		filePath, err := p.DumpConnectionPoolStats(context.Background(), tmpdir)
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+
+		assert.Empty(t, filePath)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("has stats", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"count"}).AddRow(2)
+		mock.ExpectQuery(
+			regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_connection_pool"),
+		).WillReturnRows(rows)
+
+		rows = sqlmock.NewRows([]string{"hostgroup", "srv_host", "srv_port", "status", "ConnUsed", "ConnFree", "ConnOK", "ConnERR", "Queries"}).
+			AddRow(1, "10.0.0.1", 3306, "ONLINE", 5, 10, 15, 0, 1000).
+			AddRow(2, "10.0.0.2", 3306, "SHUNNED", 0, 0, 3, 7, 20)
+		mock.ExpectQuery(
+			regexp.QuoteMeta("SELECT hostgroup, srv_host, srv_port, status, ConnUsed, ConnFree, ConnOK, ConnERR, Queries FROM stats_mysql_connection_pool"),
+		).WillReturnRows(rows)
+
+		filePath, err := p.DumpConnectionPoolStats(context.Background(), tmpdir)
+		if err != nil {
+			t.Errorf("Expected no error, but got %s instead", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+
+		hostname, _ := os.Hostname()
+
+		contents, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Errorf("Expected file to be created, but got %s", err)
+		}
+
+		expected := []string{
+			"pod_name,hostgroup,srv_host,srv_port,status,ConnUsed,ConnFree,ConnOK,ConnERR,Queries",
+			hostname + ",1,10.0.0.1,3306,ONLINE,5,10,15,0,1000",
+			hostname + ",2,10.0.0.2,3306,SHUNNED,0,0,3,7,20",
+		}
+
+		assert.Equal(t, expected, strings.Split(strings.TrimSpace(string(contents)), "\n"))
+	})
+}
+
+func TestDumpQueryDigestsReset(t *testing.T) {
+	columns := []string{
+		"hostgroup", "schemaname", "username", "client_address", "digest", "digest_text", "count_star",
+		"first_seen", "last_seen", "sum_time", "min_time", "max_time", "sum_rows_affected", "sum_rows_sent",
+	}
+
+	for _, tt := range []struct {
+		reset bool
+		table string
+	}{
+		{false, "stats_mysql_query_digest"},
+		{true, "stats_mysql_query_digest_reset"},
+	} {
+		t.Run(tt.table, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			settings := &configuration.Config{}
+			settings.Dump.Reset.Digests = tt.reset
+
+			p := &ProxySQL{conn: db, settings: settings}
+
+			// the row count always comes from the plain table, so that it doesn't reset the digests early
+			mock.ExpectQuery(
+				regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_digest"),
+			).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+			mock.ExpectQuery(
+				"FROM " + tt.table + "$",
+			).WillReturnRows(
+				sqlmock.NewRows(columns).AddRow(1, "db", "user", "", "0xABC", "SELECT ?", 1, 0, 0, 10, 10, 10, 0, 1),
+			)
+
+			_, err = p.DumpQueryDigests(t.TempDir())
+
+			assert.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCheckComponent(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hostname,
+			Namespace: "proxysql",
+			Labels: map[string]string{
+				"app":       "proxysql",
+				"component": "core",
+			},
+		},
+	}
+
+	settings := &configuration.Config{}
+	settings.Core.PodSelector.Namespace = "proxysql"
+
+	p := &ProxySQL{settings: settings, clientset: fake.NewSimpleClientset(pod)}
+
+	t.Run("matching component", func(t *testing.T) {
+		assert.NoError(t, p.checkComponent(context.Background(), "core"))
+	})
+
+	t.Run("wrong component", func(t *testing.T) {
+		err := p.checkComponent(context.Background(), "satellite")
+
+		assert.ErrorIs(t, err, ErrUnexpectedComponent)
+	})
+
+	t.Run("dump refuses to run", func(t *testing.T) {
+		p.settings.Dump.ExpectComponent = "satellite"
+
+		// no queries should be run against proxysql
+		_, err := p.DumpData(context.Background())
+
+		assert.ErrorIs(t, err, ErrUnexpectedComponent)
+	})
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	// 2024-01-02 03:04:05 UTC
+	var seconds int64 = 1704164645
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "2024-01-02T03:04:05Z"},
+		{"rfc3339", "2024-01-02T03:04:05Z"},
+		{"unix", "1704164645"},
+		{"2006-01-02 15:04:05", "2024-01-02 03:04:05"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatTimestamp(seconds, tt.format), tt.format)
+	}
+}
+
+func TestDumpQueryDigests(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Dump.TimeFormat = "unix"
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_digest"),
+	).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	// every column is named, and client_address isn't selected unless dump.include_client_address is set
+	columns := []string{
+		"hostgroup", "schemaname", "username", "digest", "digest_text", "count_star",
+		"first_seen", "last_seen", "sum_time", "min_time", "max_time", "sum_rows_affected", "sum_rows_sent",
+	}
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta("SELECT hostgroup, schemaname, username, digest, digest_text, count_star, first_seen, last_seen, "+
+			"sum_time, min_time, max_time, sum_rows_affected, sum_rows_sent FROM stats_mysql_query_digest") + "$",
+	).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(1, "db", "user", "0xABC", "SELECT ?", 2, 100, 200, 3000, 1000, 2000, 0, 2),
+	)
+
+	filePath, err := p.DumpQueryDigests(t.TempDir())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Len(t, records[1], len(records[0]), "every header should have a value")
+
+	hostname, _ := os.Hostname()
+
+	// zip the header with the values, so that each value is checked against the column it's under
+	row := map[string]string{}
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+
+	assert.Equal(t, map[string]string{
+		"pod_name":          hostname,
+		"hostgroup":         "1",
+		"schemaname":        "db",
+		"username":          "user",
+		"digest":            "0xABC",
+		"digest_text":       "SELECT ?",
+		"count_star":        "2",
+		"first_seen":        "100",
+		"last_seen":         "200",
+		"sum_time_us":       "3000",
+		"min_time_us":       "1000",
+		"max_time_us":       "2000",
+		"sum_rows_affected": "0",
+		"sum_rows_sent":     "2",
+	}, row)
+}
+
+func TestDumpQueryDigestsQuoting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
+
+	digestText := "SELECT a, b FROM t WHERE c = \"x\" AND d = 'y, z'\nORDER BY a"
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_digest"),
+	).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	columns := []string{
+		"hostgroup", "schemaname", "username", "client_address", "digest", "digest_text", "count_star",
+		"first_seen", "last_seen", "sum_time", "min_time", "max_time", "sum_rows_affected", "sum_rows_sent",
+	}
+
+	mock.ExpectQuery(
+		"FROM stats_mysql_query_digest$",
+	).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(1, "db", "user", "", "0xABC", digestText, 2, 100, 200, 3000, 1000, 2000, 0, 2),
+	)
+
+	filePath, err := p.DumpQueryDigests(t.TempDir())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Len(t, records[1], len(records[0]))
+
+	column := slices.Index(records[0], "digest_text")
+	assert.Equal(t, digestText, records[1][column])
+}
+
+func TestDumpQueryDigestsClientAddress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.Dump.IncludeClientAddress = true
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectQuery(
+		regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_digest"),
+	).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	columns := []string{
+		"hostgroup", "schemaname", "username", "client_address", "digest", "digest_text", "count_star",
+		"first_seen", "last_seen", "sum_time", "min_time", "max_time", "sum_rows_affected", "sum_rows_sent",
+	}
+
+	mock.ExpectQuery(
+		"SELECT .*, client_address, .* FROM stats_mysql_query_digest$",
+	).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(1, "db", "user", "10.0.0.1", "0xABC", "SELECT ?", 2, 100, 200, 3000, 1000, 2000, 0, 2),
+	)
+
+	filePath, err := p.DumpQueryDigests(t.TempDir())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	file, err := os.Open(filePath)
+	assert.NoError(t, err)
+
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	assert.Equal(t, []string{"pod_name", "hostgroup", "schemaname", "username", "client_address", "digest"}, records[0][:6])
+	assert.Equal(t, "10.0.0.1", records[1][4])
+	assert.Equal(t, "0xABC", records[1][5])
+	assert.Len(t, records[1], len(records[0]))
+}
+
+func TestDumpTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tmpdir := t.TempDir()
+
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
+
+	t.Run("empty table", func(t *testing.T) {
+		mock.ExpectQuery(
+			regexp.QuoteMeta("SELECT * FROM stats_mysql_global"),
+		).WillReturnRows(sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}))
+
+		filePath, err := p.DumpTable(tmpdir, "stats_mysql_global")
+
+		assert.NoError(t, err)
+		assert.Empty(t, filePath)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("has rows", func(t *testing.T) {
+		mock.ExpectQuery(
+			regexp.QuoteMeta("SELECT * FROM stats_mysql_global"),
+		).WillReturnRows(sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}).
+			AddRow("ProxySQL_Uptime", "100").
+			AddRow("Active_Transactions", nil))
+
+		filePath, err := p.DumpTable(tmpdir, "stats_mysql_global")
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		hostname, _ := os.Hostname()
+
+		assert.Equal(t, tmpdir+"/"+hostname+"-stats_mysql_global.csv", filePath)
+
+		contents, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Errorf("Expected file to be created, but got %s", err)
+		}
+
+		expected := []string{
+			"pod_name,Variable_Name,Variable_Value",
+			hostname + ",ProxySQL_Uptime,100",
+			hostname + ",Active_Transactions,",
+		}
+
+		assert.Equal(t, expected, strings.Split(strings.TrimSpace(string(contents)), "\n"))
+	})
+
+	t.Run("invalid table name", func(t *testing.T) {
+		filePath, err := p.DumpTable(tmpdir, "stats_mysql_global; DROP TABLE mysql_servers")
+
+		assert.ErrorIs(t, err, ErrInvalidTableName)
+		assert.Empty(t, filePath)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDumpDataUnknownTables(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	hostname, _ := os.Hostname()
+
+	settings := &configuration.Config{}
+	settings.Dump.OutputDir = t.TempDir()
+	// one name that isn't safe to query, one typo, and one real table
+	settings.Dump.Tables = []string{"query digest", "stats_mysql_globl", "stats_mysql_global"}
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	// nothing is run for the unsafe name
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_globl")).
+		WillReturnError(errors.New("no such table: stats_mysql_globl"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_global")).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}).AddRow("ProxySQL_Uptime", "100"))
+
+	files, err := p.DumpData(context.Background())
+
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, hostname+"-stats_mysql_global.csv", filepath.Base(files[0]))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDumpDataIncomplete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	hostname, _ := os.Hostname()
+
+	settings := &configuration.Config{}
+	settings.Dump.OutputDir = t.TempDir()
+	settings.Dump.Tables = []string{"stats_mysql_users", "stats_mysql_global"}
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_users")).
+		WillReturnError(errors.New("database is locked"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_global")).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}).AddRow("ProxySQL_Uptime", "100"))
+
+	files, err := p.DumpData(context.Background())
+
+	// the failed table is reported, and doesn't stop the other one from being dumped
+	assert.ErrorIs(t, err, ErrDumpIncomplete)
+	assert.ErrorContains(t, err, "stats_mysql_users")
+	assert.Len(t, files, 1)
+	assert.Equal(t, hostname+"-stats_mysql_global.csv", filepath.Base(files[0]))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDumpDir(t *testing.T) {
+	t.Run("creates the output directory", func(t *testing.T) {
+		outputDir := filepath.Join(t.TempDir(), "dumps", "proxysql")
+
+		dir, err := dumpDir(outputDir)
+
+		assert.NoError(t, err)
+		assert.Equal(t, outputDir, filepath.Dir(dir))
+		assert.DirExists(t, dir)
+	})
+
+	t.Run("output directory not writable", func(t *testing.T) {
+		// a regular file where the output directory should be
+		outputDir := filepath.Join(t.TempDir(), "dumps")
+		assert.NoError(t, os.WriteFile(outputDir, []byte{}, 0o600))
+
+		_, err := dumpDir(outputDir)
+
+		assert.ErrorIs(t, err, ErrOutputDirNotWritable)
+	})
+}
+
+func TestDumpEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: &configuration.Config{}}
+
+	t.Run("built-in dump", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM stats_mysql_query_rules")).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+		file, err := p.dumpEntry(t.TempDir(), "query_rule_stats")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "", file)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("other table", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM stats_mysql_global")).
+			WillReturnRows(sqlmock.NewRows([]string{"Variable_Name", "Variable_Value"}))
+
+		file, err := p.dumpEntry(t.TempDir(), "stats_mysql_global")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "", file)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+	})
+
+	t.Run("unknown table", func(t *testing.T) {
+		_, err := p.dumpEntry(t.TempDir(), "query digest")
+
+		assert.ErrorIs(t, err, ErrInvalidTableName)
+	})
+}
@@ -0,0 +1,639 @@
+package proxysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+)
+
+// Errors returned from the shutdown process. These are threaded back up to main, which maps
+// them onto distinct process exit codes so that alerting can tell the outcomes apart.
+var (
+	ErrDrainTimeout   = errors.New("timed out waiting for clients to drain")
+	ErrShutdownFailed = errors.New("proxysql shutdown command failed")
+	ErrShuttingDown   = errors.New("proxysql is shutting down")
+	ErrNotDraining    = errors.New("proxysql is not draining")
+	ErrDrainResumed   = errors.New("the drain was resumed")
+)
+
+const (
+	// How often to check the drain conditions, when shutdown.drain_poll_interval isn't set.
+	defaultDrainPollInterval = 2 * time.Second
+
+	// How long to wait between attempts at PROXYSQL PAUSE.
+	pauseRetryInterval = time.Second
+
+	// How often to check the admin port when verifying that proxysql stopped.
+	verifyStoppedInterval = 500 * time.Millisecond
+)
+
+// These are vars so that the tests can change them.
+//
+//nolint:gochecknoglobals
+var (
+	// FIXME: make this configurable?
+	drainFile = "/var/lib/proxysql/draining"
+
+	// How long to wait after killing proxysql before the shutdown is considered finished.
+	killSettleTime = 10 * time.Second
+)
+
+// The admin command run for each shutdown.command.
+//
+//nolint:gochecknoglobals
+var shutdownCommands = map[string]string{
+	"kill": "PROXYSQL KILL",
+	"slow": "PROXYSQL SHUTDOWN SLOW",
+	"fast": "PROXYSQL SHUTDOWN",
+}
+
+// ShutdownPhase tracks how far along the shutdown process the pod is.
+type ShutdownPhase int
+
+const (
+	PhaseRunning  ShutdownPhase = iota // serving traffic as normal
+	PhaseDraining                      // paused, and waiting for clients to disconnect
+	PhaseStopping                      // proxysql is being shut down
+	PhaseStopped                       // proxysql has been shut down
+)
+
+func (s ShutdownPhase) String() string {
+	switch s {
+	case PhaseRunning:
+		return "running"
+	case PhaseDraining:
+		return "draining"
+	case PhaseStopping:
+		return "stopping"
+	case PhaseStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// ShutdownPhase returns the current phase of the shutdown process.
+func (p *ProxySQL) ShutdownPhase() ShutdownPhase {
+	p.phaseMu.Lock()
+	defer p.phaseMu.Unlock()
+
+	return p.phase
+}
+
+// IsShuttingDown returns true once the shutdown process has started.
+func (p *ProxySQL) IsShuttingDown() bool {
+	return p.ShutdownPhase() != PhaseRunning
+}
+
+// Move to the next phase of the shutdown process, and notify shutdown.phase_webhook_url (if set) about it.
+func (p *ProxySQL) setShutdownPhase(phase ShutdownPhase) {
+	p.phaseMu.Lock()
+	from := p.phase
+	p.phase = phase
+	p.phaseMu.Unlock()
+
+	p.phaseChanged(from, phase)
+}
+
+// Move from one phase to another, but only if the pod is still in the first one, and Resume isn't busy undoing
+// the drain. This is what stops a resumed drain from going on to kill proxysql.
+func (p *ProxySQL) advancePhase(from ShutdownPhase, to ShutdownPhase) bool {
+	p.phaseMu.Lock()
+	if p.phase != from || p.resuming {
+		p.phaseMu.Unlock()
+
+		return false
+	}
+
+	p.phase = to
+	p.phaseMu.Unlock()
+
+	p.phaseChanged(from, to)
+
+	return true
+}
+
+// Log and export a phase change, and notify shutdown.phase_webhook_url (if set) about it.
+func (p *ProxySQL) phaseChanged(from ShutdownPhase, phase ShutdownPhase) {
+	if from == phase {
+		return
+	}
+
+	slog.Info("Shutdown phase changed", slog.String("from", from.String()), slog.String("to", phase.String()))
+	metrics.ShutdownPhase.Set(float64(phase))
+
+	// a cached result from before the shutdown started would say the pod is still healthy
+	p.invalidateProbeCache()
+
+	p.notifyPhaseChange(from, phase)
+}
+
+// PreStopShutdown is called from the /shutdown endpoint, which is used in a container preStop hook
+// to gracefully drain traffic from the pod before it's stopped.
+func (p *ProxySQL) PreStopShutdown(ctx context.Context) error {
+	return p.gracefulShutdown(ctx)
+}
+
+// Done returns a channel that is closed once the shutdown process has completed.
+func (p *ProxySQL) Done() <-chan struct{} {
+	return p.shutdownDone
+}
+
+// Run the shutdown process; both the preStop hook and the signal handler can trigger a shutdown, and whichever
+// comes second blocks until the first finishes. A shutdown that completed is never repeated, and later callers
+// get the same result. If proxysql couldn't be killed though, the pod is left half shut down, so the next caller
+// gets to try again rather than being stuck with the failure.
+func (p *ProxySQL) gracefulShutdown(ctx context.Context) error {
+	p.shutdownMu.Lock()
+	defer p.shutdownMu.Unlock()
+
+	if p.shutdownComplete {
+		return p.shutdownErr
+	}
+
+	start := time.Now()
+
+	p.shutdownErr = p.shutdown(ctx)
+
+	// a resumed drain isn't a shutdown; the pod carries on running, and can be shut down again later
+	if errors.Is(p.shutdownErr, ErrDrainResumed) {
+		return p.shutdownErr
+	}
+
+	metrics.ShutdownDuration.Observe(time.Since(start).Seconds())
+
+	// give any in-flight webhooks a chance to be delivered before the process exits
+	p.webhooks.Wait()
+
+	if errors.Is(p.shutdownErr, ErrShutdownFailed) {
+		slog.Warn("Shutdown failed, it will be retried on the next shutdown request", slog.Any("error", p.shutdownErr))
+
+		return p.shutdownErr
+	}
+
+	p.shutdownComplete = true
+
+	if p.shutdownDone != nil {
+		close(p.shutdownDone)
+	}
+
+	return p.shutdownErr
+}
+
+// Wait for a shutdown that's already in progress to finish, without starting one, and return its result. This is
+// for the signal handler on core pods, which otherwise doesn't shut proxysql down, so that the process doesn't
+// exit part way through a shutdown that the preStop hook started.
+func (p *ProxySQL) waitForShutdown() error {
+	p.shutdownMu.Lock()
+	defer p.shutdownMu.Unlock()
+
+	return p.shutdownErr
+}
+
+// Drain the clients from proxysql and then kill it. Errors are collected rather than returned
+// immediately, because we always want to proceed with the shutdown.
+func (p *ProxySQL) shutdown(ctx context.Context) error {
+	// FIXME: make this configurable
+	hasCSP := false
+
+	drainTimeout := time.Duration(p.settings.Shutdown.DrainTimeout) * time.Second
+
+	slog.Info("Pre-stop called, starting shutdown process", slog.Duration("drain_timeout", drainTimeout))
+
+	// Resume cancels the drain with this, and waits for it to return before undoing it
+	drainCtx, cancelDrain := context.WithCancel(ctx)
+	defer cancelDrain()
+
+	drained := make(chan struct{})
+
+	p.phaseMu.Lock()
+	p.cancelDrain, p.drained = cancelDrain, drained
+	p.phaseMu.Unlock()
+
+	p.setShutdownPhase(PhaseDraining)
+
+	var errs []error
+
+	err := p.drain(drainCtx, drainTimeout, time.Duration(p.settings.Shutdown.MaxDrainLifetime)*time.Second)
+
+	close(drained)
+
+	if !p.advancePhase(PhaseDraining, PhaseStopping) {
+		slog.Warn("The drain was resumed, leaving proxysql running")
+
+		return ErrDrainResumed
+	}
+
+	if err != nil {
+		slog.Error("Clients did not drain, proceeding with shutdown anyway", slog.Any("error", err))
+
+		errs = append(errs, err)
+	}
+
+	// issue the shutdown.command; PROXYSQL KILL unless configured otherwise, as the config validation fills in
+	// the default. proxysql drops our connection when it goes away, so the driver reporting a dead connection
+	// means the command worked.
+	command, ok := shutdownCommands[p.settings.Shutdown.Command]
+	if !ok {
+		command = shutdownCommands["kill"]
+	}
+
+	_, err = p.conn.ExecContext(ctx, command)
+	if err != nil && !isConnectionClosed(err) {
+		slog.Error("Shutdown command failed", slog.String("commands", command), slog.Any("error", err))
+
+		errs = append(errs, fmt.Errorf("%w: %w", ErrShutdownFailed, err))
+	}
+
+	// kill cloud-sql-proxy (CSP) if it exists
+	if hasCSP {
+		err = killCSP()
+		if err != nil {
+			slog.Error("Failed to kill CSP", slog.Any("error", err))
+		}
+	}
+
+	time.Sleep(killSettleTime)
+
+	if p.settings.Shutdown.VerifyStopped {
+		timeout := time.Duration(p.settings.Shutdown.VerifyStoppedTimeout) * time.Second
+
+		if p.verifyStopped(ctx, timeout) {
+			slog.Info("Verified that proxysql stopped")
+		} else {
+			slog.Error("ProxySQL is still accepting admin connections after being killed", slog.Duration("timeout", timeout))
+		}
+	}
+
+	p.setShutdownPhase(PhaseStopped)
+
+	return errors.Join(errs...)
+}
+
+// Poll the admin port until it refuses connections, which is the best sign we have that proxysql exited. Returns
+// false if it's still accepting connections once the timeout expires.
+func (p *ProxySQL) verifyStopped(ctx context.Context, timeout time.Duration) bool {
+	address, err := p.settings.AdminAddress()
+	if err != nil {
+		slog.Error("Unable to verify that proxysql stopped", slog.Any("error", err))
+
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			// the dial giving up because we ran out of time doesn't mean the port is closed
+			return ctx.Err() == nil
+		}
+
+		conn.Close()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(verifyStoppedInterval):
+		}
+	}
+}
+
+// Resume undoes a drain that's in progress, eg: one started by calling /shutdown by mistake. The drain is
+// stopped, the variables it changed are reloaded from disk (it never saves them) and proxysql.startup_commands are
+// run again on top, then PROXYSQL RESUME lets proxysql take new connections and the pod goes back to running. It
+// returns ErrNotDraining if there's no drain to undo, and ErrShuttingDown once the drain is over and proxysql is
+// being stopped, as it's too late by then.
+//
+// The pod stays draining until all of that has worked, so if it fails part way the probes keep reporting it as
+// draining, and either /resume or /shutdown can be called again to finish the job one way or the other.
+func (p *ProxySQL) Resume(ctx context.Context) error {
+	p.phaseMu.Lock()
+
+	if p.phase != PhaseDraining || p.resuming {
+		phase := p.phase
+		p.phaseMu.Unlock()
+
+		if phase == PhaseStopping || phase == PhaseStopped {
+			return ErrShuttingDown
+		}
+
+		return ErrNotDraining
+	}
+
+	p.resuming = true
+	cancelDrain, drained := p.cancelDrain, p.drained
+	p.phaseMu.Unlock()
+
+	slog.Info("Resuming, abandoning the drain")
+
+	err := p.resume(context.WithoutCancel(ctx), cancelDrain, drained)
+
+	p.phaseMu.Lock()
+	p.resuming = false
+
+	if err != nil {
+		p.phaseMu.Unlock()
+
+		slog.Error("Unable to resume, the pod is still draining", slog.Any("error", err))
+
+		return err
+	}
+
+	p.phase = PhaseRunning
+	p.phaseMu.Unlock()
+
+	p.phaseChanged(PhaseDraining, PhaseRunning)
+
+	slog.Info("Resumed, proxysql is accepting new connections")
+
+	return nil
+}
+
+// ResumeOnSignal resumes from a drain each time a signal is received on the channel, until the context is
+// cancelled. The shutdown that started the drain gives up without stopping proxysql, and a later one starts over.
+func (p *ProxySQL) ResumeOnSignal(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			slog.Info("Signal received, aborting the drain", slog.String("signal", sig.String()))
+
+			err := p.Resume(ctx)
+
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrNotDraining), errors.Is(err, ErrShuttingDown):
+				slog.Warn("No drain to abort", slog.String("phase", p.ShutdownPhase().String()), slog.Any("error", err))
+			default:
+				slog.Error("Unable to abort the drain", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Stop the drain and undo it, for Resume. The context isn't the caller's: once the drain has been stopped,
+// giving up half way through undoing it would leave proxysql paused with the drain's variables in place.
+func (p *ProxySQL) resume(ctx context.Context, cancelDrain context.CancelFunc, drained <-chan struct{}) error {
+	// the drain's commands could otherwise land after the ones below
+	if cancelDrain != nil {
+		cancelDrain()
+		<-drained
+	}
+
+	if err := os.Remove(drainFile); err != nil && !os.IsNotExist(err) {
+		slog.Error("Error removing drainFile", slog.String("path", drainFile), slog.Any("err", err))
+	}
+
+	for _, command := range []string{"LOAD MYSQL VARIABLES FROM DISK", "LOAD MYSQL VARIABLES TO RUNTIME"} {
+		if _, err := p.conn.ExecContext(ctx, command); err != nil {
+			return fmt.Errorf("unable to restore the mysql variables: %w", err)
+		}
+	}
+
+	p.runStartupCommands()
+
+	if _, err := p.conn.ExecContext(ctx, "PROXYSQL RESUME"); err != nil {
+		return fmt.Errorf("unable to resume proxysql: %w", err)
+	}
+
+	p.pauseFailed.Store(false)
+
+	return nil
+}
+
+// Run PROXYSQL PAUSE, retrying up to retries more times if it fails.
+func (p *ProxySQL) pause(ctx context.Context, retries int, interval time.Duration) error {
+	var err error
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("PROXYSQL PAUSE failed, retrying", slog.Int("attempt", attempt), slog.Any("error", err))
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+
+		_, err = p.conn.ExecContext(ctx, "PROXYSQL PAUSE")
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// Stop proxysql taking new connections and wait for the connected clients to go away. The watchdog bounds how
+// long the pod can stay draining, even if something in here hangs or drain_timeout is 0; when it fires, everything
+// using drainCtx gives up so that the shutdown can move on to killing proxysql. A lifetime of 0 disables it.
+func (p *ProxySQL) drain(ctx context.Context, drainTimeout, lifetime time.Duration) error {
+	drainCtx, cancelDrain := context.WithCancel(ctx)
+	defer cancelDrain()
+
+	var watchdogFired atomic.Bool
+
+	if lifetime > 0 {
+		watchdog := time.AfterFunc(lifetime, func() {
+			slog.Error("Drain watchdog fired, forcing shutdown regardless of connected clients",
+				slog.Duration("max_drain_lifetime", lifetime))
+
+			watchdogFired.Store(true)
+			cancelDrain()
+		})
+		defer watchdog.Stop()
+	}
+
+	// core pods don't drain, and the file would outlive the pod's proxysql and make the next one report draining
+	if p.settings.RunMode != "core" {
+		_, err := os.Create(drainFile)
+		if err != nil {
+			slog.Error("Error creating drainFile", slog.String("path", drainFile), slog.Any("err", err))
+		}
+	}
+
+	// the settings in the proxysql variables are all in ms
+	timeouts := drainTimeout.Milliseconds()
+
+	var err error
+
+	// disable new connections
+	commands := []string{
+		fmt.Sprintf("UPDATE global_variables SET variable_value = %d WHERE variable_name in ('mysql-connection_max_age_ms', 'mysql-max_transaction_idle_time', 'mysql-max_transaction_time')", timeouts),
+		"UPDATE global_variables SET variable_value = 1 WHERE variable_name = 'mysql-wait_timeout'",
+		"LOAD MYSQL VARIABLES TO RUNTIME",
+	}
+
+	for _, command := range commands {
+		_, err = p.conn.ExecContext(drainCtx, command)
+		if err != nil {
+			slog.Error("Command failed", slog.String("commands", command), slog.Any("error", err))
+		}
+	}
+
+	slog.Info("Pre-stop commands ran", slog.String("commands", strings.Join(commands, "; ")))
+
+	// stop accepting new connections. if this fails we still drain, but the pod keeps taking new connections
+	// while it does, so flag that in the probe results for operators.
+	err = p.pause(drainCtx, p.settings.Shutdown.PauseRetries, pauseRetryInterval)
+	if err != nil {
+		slog.Error("Unable to pause proxysql, draining while still accepting new connections", slog.Any("error", err))
+
+		p.pauseFailed.Store(true)
+	}
+
+	err = p.waitForConnectionDrain(drainCtx, drainTimeout)
+	if err != nil && watchdogFired.Load() {
+		return fmt.Errorf("%w: shutdown.max_drain_lifetime exceeded", ErrDrainTimeout)
+	}
+
+	return err
+}
+
+// Block until one of shutdown.drain_conditions is met, or until the timeout expires, checking them every
+// shutdown.drain_poll_interval seconds. A timeout of 0 waits forever.
+func (p *ProxySQL) waitForConnectionDrain(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	interval := time.Duration(p.settings.Shutdown.DrainPollInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultDrainPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if condition := p.drainComplete(); condition != "" {
+			slog.Info("Drain complete, proceeding with shutdown", slog.String("condition", condition))
+
+			metrics.DrainsTotal.WithLabelValues(condition).Inc()
+
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				metrics.DrainsTotal.WithLabelValues("timeout").Inc()
+
+				return ErrDrainTimeout
+			}
+
+			metrics.DrainsTotal.WithLabelValues("cancelled").Inc()
+
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check shutdown.drain_conditions in order, and return the first one that's been met, or an empty string if
+// none of them have. With no conditions configured the drain waits for the connections to go away.
+func (p *ProxySQL) drainComplete() string {
+	conditions := p.settings.Shutdown.DrainConditions
+	if len(conditions) == 0 {
+		conditions = []string{"connections"}
+	}
+
+	for _, condition := range conditions {
+		var met bool
+
+		switch condition {
+		case "connections":
+			met = p.safeToTerminate()
+		case "transactions":
+			met = p.noActiveTransactions()
+		case "proceed_file":
+			_, err := os.Stat(p.settings.Shutdown.ProceedFile)
+			met = err == nil
+		}
+
+		if met {
+			return condition
+		}
+	}
+
+	return ""
+}
+
+// Services that hold idle connections open can still be drained safely once nothing is mid-transaction.
+func (p *ProxySQL) noActiveTransactions() bool {
+	var transactions int
+
+	err := p.conn.QueryRow("SELECT Variable_Value FROM stats_mysql_global WHERE Variable_Name = 'Active_Transactions'").Scan(&transactions)
+	if err != nil {
+		slog.Error("Error checking for active transactions", slog.Any("err", err))
+
+		return false
+	}
+
+	if transactions > 0 {
+		slog.Info("Transactions in flight", slog.Int("transactions", transactions))
+	}
+
+	return transactions == 0
+}
+
+func (p *ProxySQL) safeToTerminate() bool {
+	// check for connected clients, and when it hits 0 return true
+	clients, err := p.ProbeClients(context.Background())
+	if err != nil {
+		slog.Error("Error in probeClients()", slog.Any("err", err))
+	} else if clients >= 0 {
+		metrics.DrainClientsRemaining.Set(float64(clients))
+	}
+
+	if clients > 0 {
+		slog.Info("Clients connected", slog.Int("clients", clients))
+	}
+
+	return clients == 0
+}
+
+// The connection to the admin interface goes away when proxysql exits.
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn)
+}
+
+// Kill cloud-sql-proxy (CSP) if it is running; this should be optional and configurable,
+// or moved into a plugin down the road.
+func killCSP() error {
+	// Make an HTTP request to localhost:9091/quitquitquit
+	resp, err := http.Get("http://localhost:9091/quitquitquit")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check the response status
+	if resp.StatusCode == http.StatusOK {
+		slog.Info("Killed CSP")
+	} else {
+		slog.Warn("HTTP request to CSP failed", slog.String("status", resp.Status))
+	}
+
+	return nil
+}
@@ -0,0 +1,692 @@
+package proxysql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+)
+
+// The number of shutdowns recorded in the shutdown duration histogram.
+func shutdownsObserved(t *testing.T) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+
+	err := metrics.ShutdownDuration.Write(&metric)
+	assert.NoError(t, err)
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestWaitForConnectionDrain(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	query := regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")
+
+	t.Run("clients drained", func(t *testing.T) {
+		drained := testutil.ToFloat64(metrics.DrainsTotal.WithLabelValues("connections"))
+
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+
+		err := p.waitForConnectionDrain(context.Background(), time.Second)
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.InDelta(t, drained+1, testutil.ToFloat64(metrics.DrainsTotal.WithLabelValues("connections")), 0)
+		assert.InDelta(t, 0, testutil.ToFloat64(metrics.DrainClientsRemaining), 0)
+	})
+
+	t.Run("drain timed out", func(t *testing.T) {
+		timeouts := testutil.ToFloat64(metrics.DrainsTotal.WithLabelValues("timeout"))
+
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+
+		err := p.waitForConnectionDrain(context.Background(), 50*time.Millisecond)
+
+		assert.ErrorIs(t, err, ErrDrainTimeout)
+		assert.NoError(t, mock.ExpectationsWereMet())
+		assert.InDelta(t, timeouts+1, testutil.ToFloat64(metrics.DrainsTotal.WithLabelValues("timeout")), 0)
+		assert.InDelta(t, 5, testutil.ToFloat64(metrics.DrainClientsRemaining), 0)
+	})
+
+	t.Run("clients leave between polls", func(t *testing.T) {
+		settings := *tmpConfig
+		settings.Shutdown.DrainPollInterval = 1
+
+		p := &ProxySQL{conn: db, settings: &settings}
+
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+		mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+
+		start := time.Now()
+
+		err := p.waitForConnectionDrain(context.Background(), time.Minute)
+
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second, "the next poll should see the clients gone, long before the timeout")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDrainComplete(t *testing.T) {
+	clients := regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")
+	transactions := regexp.QuoteMeta("SELECT Variable_Value FROM stats_mysql_global WHERE Variable_Name = 'Active_Transactions'")
+
+	proceedFile := filepath.Join(t.TempDir(), "proceed")
+
+	for _, tt := range []struct {
+		name       string
+		conditions []string
+		expect     func(mock sqlmock.Sqlmock)
+		proceed    bool
+		met        string
+	}{
+		{
+			name: "defaults to connections",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(clients).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+			},
+			met: "connections",
+		},
+		{
+			name:       "idle clients, no transactions",
+			conditions: []string{"connections", "transactions"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(clients).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+				mock.ExpectQuery(transactions).WillReturnRows(sqlmock.NewRows([]string{"Variable_Value"}).AddRow("0"))
+			},
+			met: "transactions",
+		},
+		{
+			name:       "transactions in flight",
+			conditions: []string{"transactions", "proceed_file"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(transactions).WillReturnRows(sqlmock.NewRows([]string{"Variable_Value"}).AddRow("2"))
+			},
+			met: "",
+		},
+		{
+			name:       "proceed file created",
+			conditions: []string{"connections", "proceed_file"},
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(clients).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+			},
+			proceed: true,
+			met:     "proceed_file",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Failed to create mock database connection: %v", err)
+			}
+			defer db.Close()
+
+			if tt.proceed {
+				_, err := os.Create(proceedFile)
+				assert.NoError(t, err)
+
+				defer os.Remove(proceedFile)
+			}
+
+			settings := &configuration.Config{}
+			settings.Shutdown.DrainConditions = tt.conditions
+			settings.Shutdown.ProceedFile = proceedFile
+
+			p := &ProxySQL{conn: db, settings: settings}
+
+			tt.expect(mock)
+
+			assert.Equal(t, tt.met, p.drainComplete())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGracefulShutdownOnce(t *testing.T) {
+	p := &ProxySQL{settings: tmpConfig, shutdownDone: make(chan struct{})}
+
+	// pretend a shutdown already completed, so that the second call returns the stored result
+	p.shutdownComplete = true
+	p.shutdownErr = ErrDrainTimeout
+
+	close(p.shutdownDone)
+
+	err := p.gracefulShutdown(context.Background())
+
+	assert.ErrorIs(t, err, ErrDrainTimeout)
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("Done() should be closed after shutdown")
+	}
+}
+
+func TestGracefulShutdownRetry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	defer func(settle time.Duration) { killSettleTime = settle }(killSettleTime)
+	killSettleTime = 0
+
+	p := &ProxySQL{conn: db, settings: tmpConfig, shutdownDone: make(chan struct{})}
+
+	expectShutdown := func(killErr error) {
+		mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+		mock.ExpectExec("PROXYSQL KILL").WillReturnError(killErr)
+	}
+
+	t.Run("failed shutdown", func(t *testing.T) {
+		expectShutdown(errors.New("kill failed"))
+
+		err := p.gracefulShutdown(context.Background())
+
+		assert.ErrorIs(t, err, ErrShutdownFailed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		select {
+		case <-p.Done():
+			t.Error("Done() shouldn't be closed after a failed shutdown")
+		default:
+		}
+	})
+
+	t.Run("retried shutdown", func(t *testing.T) {
+		shutdowns := shutdownsObserved(t)
+
+		// proxysql dropping the connection means the kill worked
+		expectShutdown(mysql.ErrInvalidConn)
+
+		err := p.gracefulShutdown(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, shutdowns+1, shutdownsObserved(t))
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		select {
+		case <-p.Done():
+		default:
+			t.Error("Done() should be closed after the shutdown succeeds")
+		}
+	})
+
+	t.Run("successful shutdown isn't repeated", func(t *testing.T) {
+		// no commands should be run
+		err := p.gracefulShutdown(context.Background())
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestShutdownCommand(t *testing.T) {
+	defer func(settle time.Duration) { killSettleTime = settle }(killSettleTime)
+	killSettleTime = 0
+
+	tests := []struct {
+		command string
+		query   string
+	}{
+		{"kill", "PROXYSQL KILL"},
+		{"slow", "PROXYSQL SHUTDOWN SLOW"},
+		{"fast", "PROXYSQL SHUTDOWN$"},
+		{"", "PROXYSQL KILL"}, // not set, eg: a Config that didn't come from Configure
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err, "Error creating mock database")
+
+			defer db.Close()
+
+			settings := *tmpConfig
+			settings.Shutdown.Command = tt.command
+
+			p := &ProxySQL{conn: db, settings: &settings, shutdownDone: make(chan struct{})}
+
+			mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+			mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+				WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+			mock.ExpectExec(tt.query).WillReturnError(mysql.ErrInvalidConn)
+
+			assert.NoError(t, p.shutdown(context.Background()))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGracefulShutdownConcurrent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	defer func(file string, settle time.Duration) {
+		drainFile = file
+		killSettleTime = settle
+	}(drainFile, killSettleTime)
+
+	drainFile = filepath.Join(t.TempDir(), "draining")
+	killSettleTime = 0
+
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	p := &ProxySQL{conn: db, settings: settings, shutdownDone: make(chan struct{})}
+
+	// only one shutdown's worth of queries; if both callers ran the shutdown, the second would fail on
+	// unexpected queries. the delay on the kill keeps the first shutdown in progress while the others arrive.
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+	mock.ExpectExec("PROXYSQL KILL").WillDelayFor(100 * time.Millisecond).WillReturnError(mysql.ErrInvalidConn)
+
+	start := make(chan struct{})
+	results := make(chan error, 2)
+
+	// the preStop hook
+	go func() {
+		<-start
+		results <- p.PreStopShutdown(context.Background())
+	}()
+
+	// the signal handler in the satellite loop
+	go func() {
+		<-start
+		results <- p.gracefulShutdown(context.Background())
+	}()
+
+	close(start)
+
+	// the signal handler in the core loop waits for the shutdown, rather than exiting part way through it
+	assert.Eventually(t, p.IsShuttingDown, time.Second, time.Millisecond)
+	assert.NoError(t, p.waitForShutdown())
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("Done() should be closed once waitForShutdown returns")
+	}
+
+	for range 2 {
+		select {
+		case err := <-results:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("both shutdown requests should return")
+		}
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, PhaseStopped, p.ShutdownPhase())
+}
+
+func TestResumePhaseGuard(t *testing.T) {
+	tests := []struct {
+		phase ShutdownPhase
+		err   error
+	}{
+		{PhaseRunning, ErrNotDraining},
+		{PhaseStopping, ErrShuttingDown},
+		{PhaseStopped, ErrShuttingDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.phase.String(), func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			assert.NoError(t, err, "Error creating mock database")
+
+			defer db.Close()
+
+			p := &ProxySQL{conn: db, settings: tmpConfig, phase: tt.phase}
+
+			err = p.Resume(context.Background())
+
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.phase, p.ShutdownPhase(), "the phase shouldn't change")
+			assert.NoError(t, mock.ExpectationsWereMet(), "nothing should be run")
+		})
+	}
+}
+
+func TestResumeDrain(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	defer func(file string) { drainFile = file }(drainFile)
+
+	drainFile = filepath.Join(t.TempDir(), "draining")
+
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	p := &ProxySQL{conn: db, settings: settings, shutdownDone: make(chan struct{})}
+
+	result := startStuckDrain(t, p, mock)
+
+	mock.ExpectExec("LOAD MYSQL VARIABLES FROM DISK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PROXYSQL RESUME").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, p.Resume(context.Background()))
+
+	// the shutdown gives up rather than killing proxysql, which would be an unexpected query
+	assert.ErrorIs(t, <-result, ErrDrainResumed)
+	assert.Equal(t, PhaseRunning, p.ShutdownPhase())
+	assert.NoFileExists(t, drainFile)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	select {
+	case <-p.Done():
+		t.Error("Done() shouldn't be closed after a resumed drain")
+	default:
+	}
+
+	t.Run("resuming twice", func(t *testing.T) {
+		assert.ErrorIs(t, p.Resume(context.Background()), ErrNotDraining)
+	})
+}
+
+func TestResumeFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	defer func(file string) { drainFile = file }(drainFile)
+
+	drainFile = filepath.Join(t.TempDir(), "draining")
+
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	p := &ProxySQL{conn: db, settings: settings, shutdownDone: make(chan struct{})}
+
+	result := startStuckDrain(t, p, mock)
+
+	mock.ExpectExec("LOAD MYSQL VARIABLES FROM DISK").WillReturnError(errors.New("disk error"))
+
+	assert.ErrorContains(t, p.Resume(context.Background()), "disk error")
+
+	// the drain was stopped, but proxysql is still paused, so the pod mustn't look like it's running
+	assert.ErrorIs(t, <-result, ErrDrainResumed)
+	assert.Equal(t, PhaseDraining, p.ShutdownPhase())
+	assert.True(t, p.IsShuttingDown())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	t.Run("resuming again", func(t *testing.T) {
+		mock.ExpectExec("LOAD MYSQL VARIABLES FROM DISK").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("PROXYSQL RESUME").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		// the request going away part way through doesn't leave the restore half done
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.NoError(t, p.Resume(ctx))
+		assert.Equal(t, PhaseRunning, p.ShutdownPhase())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestResumeOnSignal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	defer func(file string) { drainFile = file }(drainFile)
+
+	drainFile = filepath.Join(t.TempDir(), "draining")
+
+	defer func(settle time.Duration) { killSettleTime = settle }(killSettleTime)
+	killSettleTime = 0
+
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	p := &ProxySQL{conn: db, settings: settings, shutdownDone: make(chan struct{})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal)
+
+	go p.ResumeOnSignal(ctx, signals)
+
+	result := startStuckDrain(t, p, mock)
+
+	mock.ExpectExec("LOAD MYSQL VARIABLES FROM DISK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PROXYSQL RESUME").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	signals <- syscall.SIGUSR2
+
+	assert.ErrorIs(t, <-result, ErrDrainResumed)
+	assert.Eventually(t, func() bool {
+		return p.ShutdownPhase() == PhaseRunning
+	}, 5*time.Second, 10*time.Millisecond, "the pod should be back to running")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	t.Run("shutting down again", func(t *testing.T) {
+		// this time the clients are gone, and the drain carries on to kill proxysql
+		mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+		mock.ExpectExec("PROXYSQL KILL").WillReturnError(mysql.ErrInvalidConn)
+
+		assert.NoError(t, p.PreStopShutdown(context.Background()))
+		assert.Equal(t, PhaseStopped, p.ShutdownPhase())
+		assert.NoError(t, mock.ExpectationsWereMet())
+
+		select {
+		case <-p.Done():
+		default:
+			t.Error("Done() should be closed after the shutdown completes")
+		}
+	})
+}
+
+// Start a shutdown whose clients never go away, so that the drain waits until it's resumed, and return the
+// shutdown's result.
+func startStuckDrain(t *testing.T, p *ProxySQL, mock sqlmock.Sqlmock) <-chan error {
+	t.Helper()
+
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+
+	result := make(chan error, 1)
+
+	go func() {
+		result <- p.PreStopShutdown(context.Background())
+	}()
+
+	assert.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, 5*time.Second, 10*time.Millisecond, "the drain should be waiting for the clients")
+	assert.Equal(t, PhaseDraining, p.ShutdownPhase())
+	assert.FileExists(t, drainFile)
+
+	return result
+}
+
+func TestVerifyStopped(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.Address = listener.Addr().String()
+
+	p := &ProxySQL{settings: settings}
+
+	t.Run("still running", func(t *testing.T) {
+		assert.False(t, p.verifyStopped(context.Background(), 100*time.Millisecond))
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		time.AfterFunc(100*time.Millisecond, func() { listener.Close() })
+
+		assert.True(t, p.verifyStopped(context.Background(), 5*time.Second))
+	})
+}
+
+func TestPause(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	t.Run("succeeds after a retry", func(t *testing.T) {
+		mock.ExpectExec("PROXYSQL PAUSE").WillReturnError(errors.New("transient error"))
+		mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err := p.pause(context.Background(), 3, time.Millisecond)
+
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		for range 3 {
+			mock.ExpectExec("PROXYSQL PAUSE").WillReturnError(errors.New("transient error"))
+		}
+
+		err := p.pause(context.Background(), 2, time.Millisecond)
+
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDrainWatchdog(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	p := &ProxySQL{conn: db, settings: tmpConfig}
+
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(5))
+
+	start := time.Now()
+
+	// a drain timeout of 0 waits forever, so only the watchdog can end this
+	err = p.drain(context.Background(), 0, 50*time.Millisecond)
+
+	assert.ErrorIs(t, err, ErrDrainTimeout)
+	assert.Less(t, time.Since(start), defaultDrainPollInterval)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDrainFile(t *testing.T) {
+	defer func(file string) { drainFile = file }(drainFile)
+
+	for _, tt := range []struct {
+		runMode string
+		created bool
+	}{
+		{"core", false},
+		{"satellite", true},
+	} {
+		t.Run(tt.runMode, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Failed to create mock database connection: %v", err)
+			}
+			defer db.Close()
+
+			drainFile = filepath.Join(t.TempDir(), "draining")
+
+			settings := &configuration.Config{RunMode: tt.runMode}
+
+			p := &ProxySQL{conn: db, settings: settings}
+
+			mock.ExpectExec("UPDATE global_variables SET variable_value = 0").WillReturnResult(sqlmock.NewResult(0, 3))
+			mock.ExpectExec("UPDATE global_variables SET variable_value = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("LOAD MYSQL VARIABLES TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("PROXYSQL PAUSE").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(regexp.QuoteMeta("select sum(ConnUsed) from stats_mysql_connection_pool")).
+				WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+
+			err = p.drain(context.Background(), 0, 0)
+
+			assert.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+			assert.Equal(t, tt.created, probeDraining())
+		})
+	}
+}
+
+func TestRemoveStaleDrainFile(t *testing.T) {
+	defer func(file string) { drainFile = file }(drainFile)
+
+	drainFile = filepath.Join(t.TempDir(), "draining")
+
+	_, err := os.Create(drainFile)
+	assert.NoError(t, err)
+	assert.True(t, probeDraining())
+
+	removeStaleDrainFile()
+
+	assert.False(t, probeDraining())
+
+	// and it's fine when there's nothing to remove
+	removeStaleDrainFile()
+}
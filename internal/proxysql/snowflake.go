@@ -0,0 +1,121 @@
+package proxysql
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/snowflakedb/gosnowflake"
+)
+
+// ErrInvalidPrivateKey is returned from uploadToSnowflake when dump.snowflake.private_key_file isn't a PKCS8 RSA key.
+var ErrInvalidPrivateKey = errors.New("invalid snowflake private key")
+
+// Open the connection to snowflake; overridden in tests.
+var openSnowflake = func(settings *configuration.Config) (*sql.DB, error) { //nolint:gochecknoglobals
+	key, err := loadPrivateKey(settings.Dump.Snowflake.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := gosnowflake.Config{
+		Account:       settings.Dump.Snowflake.Account,
+		User:          settings.Dump.Snowflake.User,
+		Warehouse:     settings.Dump.Snowflake.Warehouse,
+		Database:      settings.Dump.Snowflake.Database,
+		Schema:        settings.Dump.Snowflake.Schema,
+		Authenticator: gosnowflake.AuthTypeJwt,
+		PrivateKey:    key,
+	}
+
+	return sql.OpenDB(gosnowflake.NewConnector(gosnowflake.SnowflakeDriver{}, config)), nil
+}
+
+// Whether a snowflake account is configured to upload the dumps to.
+func (p *ProxySQL) snowflakeEnabled() bool {
+	return p.settings.Dump.Snowflake.Account != ""
+}
+
+// uploadToSnowflake PUTs a dump file to the configured stage, then loads it into the configured table with
+// COPY INTO, and returns where it was staged, eg: @proxysql_stage/digests.csv.gz. The stage and table were
+// checked to be plain identifiers when the config was loaded.
+func (p *ProxySQL) uploadToSnowflake(ctx context.Context, file string) (string, error) {
+	db, err := openSnowflake(p.settings)
+	if err != nil {
+		return "", err
+	}
+
+	defer db.Close()
+
+	put, copyInto := snowflakeStatements(p.settings.Dump.Snowflake.Stage, p.settings.Dump.Snowflake.Table, file)
+
+	if _, err := db.ExecContext(ctx, put); err != nil {
+		return "", fmt.Errorf("unable to PUT %s: %w", file, err)
+	}
+
+	if _, err := db.ExecContext(ctx, copyInto); err != nil {
+		return "", fmt.Errorf("unable to COPY %s into %s: %w", file, p.settings.Dump.Snowflake.Table, err)
+	}
+
+	return "@" + p.settings.Dump.Snowflake.Stage + "/" + stagedName(file), nil
+}
+
+// The name of a dump file once it's been PUT to the stage. PUT gzips the file on the way up unless it was
+// compressed with dump.compress already, so the staged file always has a .gz suffix.
+func stagedName(file string) string {
+	staged := filepath.Base(file)
+	if !strings.HasSuffix(staged, ".gz") {
+		staged += ".gz"
+	}
+
+	return staged
+}
+
+// Build the PUT and COPY INTO statements for a dump file. The dumps have a header row, and fields containing
+// commas, quotes or newlines are quoted.
+func snowflakeStatements(stage string, table string, file string) (string, string) {
+	staged := stagedName(file)
+
+	// single quotes would end the quoted path early
+	path := strings.ReplaceAll(file, "'", `\'`)
+	staged = strings.ReplaceAll(staged, "'", `\'`)
+
+	put := fmt.Sprintf("PUT 'file://%s' @%s AUTO_COMPRESS = TRUE OVERWRITE = TRUE", path, stage)
+	copyInto := fmt.Sprintf(`COPY INTO %s FROM @%s FILES = ('%s') FILE_FORMAT = (TYPE = CSV SKIP_HEADER = 1 FIELD_OPTIONALLY_ENCLOSED_BY = '"')`,
+		table, stage, staged)
+
+	return put, copyInto
+}
+
+// Read the PKCS8 PEM encoded RSA key used for snowflake key pair authentication.
+func loadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s contains no PEM data", ErrInvalidPrivateKey, file)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPrivateKey, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an RSA key", ErrInvalidPrivateKey, file)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,130 @@
+package proxysql
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+)
+
+func TestSnowflakeStatements(t *testing.T) {
+	put, copyInto := snowflakeStatements("proxysql_stage", "analytics.proxysql.query_digests", "/tmp/123/proxysql-satellite-0-digests.csv")
+
+	assert.Equal(t, "PUT 'file:///tmp/123/proxysql-satellite-0-digests.csv' @proxysql_stage AUTO_COMPRESS = TRUE OVERWRITE = TRUE", put)
+	assert.Equal(t, `COPY INTO analytics.proxysql.query_digests FROM @proxysql_stage FILES = ('proxysql-satellite-0-digests.csv.gz') `+
+		`FILE_FORMAT = (TYPE = CSV SKIP_HEADER = 1 FIELD_OPTIONALLY_ENCLOSED_BY = '"')`, copyInto)
+
+	// already compressed with dump.compress
+	_, copyInto = snowflakeStatements("proxysql_stage", "query_digests", "/tmp/123/proxysql-satellite-0-digests.csv.gz")
+
+	assert.Contains(t, copyInto, "FILES = ('proxysql-satellite-0-digests.csv.gz')")
+}
+
+func TestUploadToSnowflake(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err, "Error creating mock database")
+
+	original := openSnowflake
+	openSnowflake = func(_ *configuration.Config) (*sql.DB, error) { return db, nil }
+
+	t.Cleanup(func() {
+		openSnowflake = original
+	})
+
+	settings := &configuration.Config{}
+	settings.Dump.Snowflake.Account = "myorg-myaccount"
+	settings.Dump.Snowflake.Stage = "proxysql_stage"
+	settings.Dump.Snowflake.Table = "query_digests"
+
+	p := &ProxySQL{settings: settings}
+
+	t.Run("uploaded", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "digests.csv")
+		assert.NoError(t, os.WriteFile(file, []byte("pod_name\n"), 0o600))
+
+		mock.ExpectExec(regexp.QuoteMeta("PUT 'file://" + file + "' @proxysql_stage")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("COPY INTO query_digests FROM @proxysql_stage FILES = ('digests.csv.gz')")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		location, err := p.uploadDump(context.Background(), "query_digest", file)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "@proxysql_stage/digests.csv.gz", location)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+		assert.NoFileExists(t, file)
+	})
+
+	t.Run("upload fails", func(t *testing.T) {
+		db, mock, err = sqlmock.New()
+		assert.NoError(t, err, "Error creating mock database")
+
+		file := filepath.Join(t.TempDir(), "digests.csv")
+		assert.NoError(t, os.WriteFile(file, []byte("pod_name\n"), 0o600))
+
+		mock.ExpectExec(regexp.QuoteMeta("PUT 'file://" + file + "' @proxysql_stage")).
+			WillReturnError(errors.New("stage does not exist"))
+
+		location, err := p.uploadDump(context.Background(), "query_digest", file)
+
+		assert.ErrorContains(t, err, "stage does not exist")
+		assert.Equal(t, file, location)
+		assert.NoError(t, mock.ExpectationsWereMet(), "SQL expectations were not met")
+		assert.FileExists(t, file)
+	})
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+
+	writeKey := func(name string, key any) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+
+		file := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+		return file
+	}
+
+	t.Run("rsa key", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+
+		key, err := loadPrivateKey(writeKey("rsa.pem", rsaKey))
+
+		assert.NoError(t, err)
+		assert.True(t, rsaKey.Equal(key))
+	})
+
+	t.Run("not an rsa key", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+
+		_, err = loadPrivateKey(writeKey("ec.pem", ecKey))
+
+		assert.ErrorIs(t, err, ErrInvalidPrivateKey)
+	})
+
+	t.Run("not PEM", func(t *testing.T) {
+		file := filepath.Join(dir, "garbage.pem")
+		assert.NoError(t, os.WriteFile(file, []byte("garbage"), 0o600))
+
+		_, err := loadPrivateKey(file)
+
+		assert.ErrorIs(t, err, ErrInvalidPrivateKey)
+	})
+}
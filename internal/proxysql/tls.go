@@ -0,0 +1,47 @@
+package proxysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+)
+
+// Build the TLS config for the admin connection from proxysql.tls. The driver fills in the server name from
+// proxysql.address, so the certificate is verified against that unless skip_verify is set.
+func tlsConfig(settings *configuration.Config) (*tls.Config, error) {
+	opts := settings.ProxySQL.TLS
+
+	//nolint:gosec // skip_verify is opt in, and documented as not for production use
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.SkipVerify,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", configuration.ErrInvalidTLSConfig, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", configuration.ErrInvalidTLSConfig, opts.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", configuration.ErrInvalidTLSConfig, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
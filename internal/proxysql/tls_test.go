@@ -0,0 +1,96 @@
+package proxysql
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a self signed certificate and its key to dir, returning their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxysql"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	assert.NoError(t, err)
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	assert.NoError(t, err)
+
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	certFile, keyFile := writeTestCert(t, dir)
+
+	t.Run("ca and client certificate", func(t *testing.T) {
+		settings := &configuration.Config{}
+		settings.ProxySQL.TLS.Enabled = true
+		settings.ProxySQL.TLS.CAFile = certFile
+		settings.ProxySQL.TLS.CertFile = certFile
+		settings.ProxySQL.TLS.KeyFile = keyFile
+
+		config, err := tlsConfig(settings)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, config.RootCAs)
+		assert.Len(t, config.Certificates, 1)
+		assert.False(t, config.InsecureSkipVerify)
+	})
+
+	t.Run("system roots", func(t *testing.T) {
+		settings := &configuration.Config{}
+		settings.ProxySQL.TLS.Enabled = true
+		settings.ProxySQL.TLS.SkipVerify = true
+
+		config, err := tlsConfig(settings)
+
+		assert.NoError(t, err)
+		assert.Nil(t, config.RootCAs)
+		assert.Empty(t, config.Certificates)
+		assert.True(t, config.InsecureSkipVerify)
+	})
+
+	t.Run("ca file without certificates", func(t *testing.T) {
+		settings := &configuration.Config{}
+		settings.ProxySQL.TLS.Enabled = true
+		settings.ProxySQL.TLS.CAFile = keyFile
+
+		_, err := tlsConfig(settings)
+
+		assert.ErrorIs(t, err, configuration.ErrInvalidTLSConfig)
+	})
+}
@@ -0,0 +1,145 @@
+package proxysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Uploader stores a dump file under a key, off the pod.
+type Uploader interface {
+	Upload(ctx context.Context, key string, body io.Reader) error
+}
+
+// s3Uploader uploads the dump files to dump.s3.bucket.
+type s3Uploader struct {
+	client *s3.Client
+	bucket string
+}
+
+// Create the S3 uploader. Credentials come from the default chain, so IRSA or the instance profile are used
+// when running in EKS.
+func newS3Uploader(ctx context.Context, bucket string, region string) (*s3Uploader, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the AWS configuration: %w", err)
+	}
+
+	return &s3Uploader{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+}
+
+func (u *s3Uploader) Upload(ctx context.Context, key string, body io.Reader) error {
+	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(u.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+
+	return err
+}
+
+// Whether an S3 bucket is configured to upload the dumps to.
+func (p *ProxySQL) s3Enabled() bool {
+	return p.settings.Dump.S3.Bucket != ""
+}
+
+// uploadToS3 uploads a dump file to <dump.s3.prefix>/<hostname>/<timestamp>/<file name>, so that dumps from
+// different pods and runs don't overwrite each other, and returns the object's s3:// URL.
+func (p *ProxySQL) uploadToS3(ctx context.Context, file string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = os.Getenv("HOSTNAME")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	key := s3Key(p.settings.Dump.S3.Prefix, hostname, time.Now(), file)
+
+	url := "s3://" + p.settings.Dump.S3.Bucket + "/" + key
+
+	if err := p.uploader.Upload(ctx, key, f); err != nil {
+		return "", fmt.Errorf("unable to upload %s to %s: %w", file, url, err)
+	}
+
+	slog.Info("Uploaded dump file to S3", slog.String("filename", file), slog.String("key", key))
+
+	return url, nil
+}
+
+// Build the object key for a dump file.
+func s3Key(prefix string, hostname string, now time.Time, file string) string {
+	return path.Join(strings.Trim(prefix, "/"), hostname, now.UTC().Format("20060102T150405Z"), filepath.Base(file))
+}
+
+// Ship a dump file to wherever it's configured to go: S3 for every dump, and snowflake for the query digests.
+// The local file is removed once it has been uploaded, and kept if any upload failed so that it can be
+// loaded by hand. Returns where the dump ended up: the S3 object if it was uploaded there, the staged file if it
+// only went to snowflake, or the local file if it was kept.
+func (p *ProxySQL) uploadDump(ctx context.Context, table string, file string) (string, error) {
+	location := ""
+
+	var errs []error
+
+	if p.s3Enabled() {
+		url, err := p.uploadToS3(ctx, file)
+		if err != nil {
+			slog.Error("Unable to upload the dump file to S3", slog.String("filename", file), slog.Any("error", err))
+
+			errs = append(errs, err)
+		} else {
+			location = url
+		}
+	}
+
+	if table == "query_digest" && p.snowflakeEnabled() {
+		staged, err := p.uploadToSnowflake(ctx, file)
+		if err != nil {
+			slog.Error("Unable to upload the query digests to snowflake", slog.String("filename", file), slog.Any("error", err))
+
+			errs = append(errs, err)
+		} else {
+			slog.Info("Uploaded the query digests to snowflake", slog.String("table", p.settings.Dump.Snowflake.Table))
+
+			if location == "" {
+				location = staged
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		slog.Warn("Keeping the local dump file", slog.String("filename", file))
+
+		return file, errors.Join(errs...)
+	}
+
+	if location == "" {
+		return file, nil
+	}
+
+	if err := os.Remove(file); err != nil {
+		slog.Warn("Unable to remove the uploaded dump file", slog.String("filename", file), slog.Any("error", err))
+	}
+
+	return location, nil
+}
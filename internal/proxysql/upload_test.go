@@ -0,0 +1,99 @@
+package proxysql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUploader records what it was asked to upload, and fails if err is set.
+type fakeUploader struct {
+	uploads map[string]string
+	err     error
+}
+
+func (f *fakeUploader) Upload(_ context.Context, key string, body io.Reader) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	f.uploads[key] = string(data)
+
+	return nil
+}
+
+func TestS3Key(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, "proxysql/dumps/proxysql-satellite-0/20240102T030405Z/proxysql-satellite-0-digests.csv",
+		s3Key("/proxysql/dumps/", "proxysql-satellite-0", now, "/tmp/123/proxysql-satellite-0-digests.csv"))
+	assert.Equal(t, "proxysql-satellite-0/20240102T030405Z/proxysql-satellite-0-digests.csv",
+		s3Key("", "proxysql-satellite-0", now, "/tmp/123/proxysql-satellite-0-digests.csv"))
+}
+
+func TestUploadDumpToS3(t *testing.T) {
+	settings := &configuration.Config{}
+	settings.Dump.S3.Bucket = "proxysql-dumps"
+	settings.Dump.S3.Prefix = "dumps"
+
+	t.Run("uploaded", func(t *testing.T) {
+		uploader := &fakeUploader{uploads: map[string]string{}}
+		p := &ProxySQL{settings: settings, uploader: uploader}
+
+		file := filepath.Join(t.TempDir(), "rules.csv")
+		assert.NoError(t, os.WriteFile(file, []byte("pod_name,rule_id\n"), 0o600))
+
+		location, err := p.uploadDump(context.Background(), "query_rules", file)
+
+		assert.NoError(t, err)
+		assert.Len(t, uploader.uploads, 1)
+
+		for key, body := range uploader.uploads {
+			assert.Regexp(t, `^dumps/[^/]+/\d{8}T\d{6}Z/rules\.csv$`, key)
+			assert.Equal(t, "pod_name,rule_id\n", body)
+			assert.Equal(t, "s3://proxysql-dumps/"+key, location, "the object should be reported rather than the deleted file")
+		}
+
+		assert.NoFileExists(t, file)
+	})
+
+	t.Run("upload fails", func(t *testing.T) {
+		uploader := &fakeUploader{uploads: map[string]string{}, err: errors.New("access denied")}
+		p := &ProxySQL{settings: settings, uploader: uploader}
+
+		file := filepath.Join(t.TempDir(), "rules.csv")
+		assert.NoError(t, os.WriteFile(file, []byte("pod_name,rule_id\n"), 0o600))
+
+		location, err := p.uploadDump(context.Background(), "query_rules", file)
+
+		assert.ErrorContains(t, err, "access denied")
+		assert.Equal(t, file, location)
+		assert.Empty(t, uploader.uploads)
+		assert.FileExists(t, file)
+	})
+
+	t.Run("uploads disabled", func(t *testing.T) {
+		p := &ProxySQL{settings: &configuration.Config{}}
+
+		file := filepath.Join(t.TempDir(), "rules.csv")
+		assert.NoError(t, os.WriteFile(file, []byte("pod_name,rule_id\n"), 0o600))
+
+		location, err := p.uploadDump(context.Background(), "query_rules", file)
+
+		assert.NoError(t, err)
+		assert.Equal(t, file, location)
+		assert.FileExists(t, file)
+	})
+}
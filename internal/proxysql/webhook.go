@@ -0,0 +1,184 @@
+package proxysql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Webhooks are best effort, so they get a short timeout.
+const webhookTimeout = 5 * time.Second
+
+// The client the webhooks are sent with; overridden in tests.
+var webhookClient = http.DefaultClient //nolint:gochecknoglobals
+
+// PhaseEvent is the payload sent to shutdown.phase_webhook_url on each shutdown phase change.
+type PhaseEvent struct {
+	Pod       string    `json:"pod"`
+	From      string    `json:"from_phase"`
+	To        string    `json:"to_phase"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Send the phase change to the webhook in the background; failures are logged, and never block the
+// shutdown process.
+func (p *ProxySQL) notifyPhaseChange(from, to ShutdownPhase) {
+	url := p.settings.Shutdown.PhaseWebhookURL
+	if url == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+
+	event := PhaseEvent{
+		Pod:       hostname,
+		From:      from.String(),
+		To:        to.String(),
+		Timestamp: time.Now().UTC(),
+	}
+
+	p.webhooks.Add(1)
+
+	go func() {
+		defer p.webhooks.Done()
+
+		err := postJSON(context.Background(), url, event, webhookTimeout)
+		if err != nil {
+			slog.Warn("Failed to send shutdown phase webhook", slog.String("url", url), slog.Any("error", err))
+		}
+	}()
+}
+
+// MembershipEvent is the payload sent to notifications.webhook_url when a pod joins or leaves the cluster.
+type MembershipEvent struct {
+	Event          string    `json:"event"` // pod_joined or pod_left
+	Pod            string    `json:"pod"`
+	IP             string    `json:"ip"`
+	Timestamp      time.Time `json:"timestamp"`
+	ClusterMembers int       `json:"cluster_members"` // rows in proxysql_servers afterwards; -1 if they couldn't be counted
+}
+
+// Send the membership change to the webhook in the background, so that a slow or failing webhook never holds up
+// the cluster changes; failures are only logged.
+func (p *ProxySQL) notifyMembershipChange(event string, pod *v1.Pod, members int) {
+	url := p.settings.Notifications.WebhookURL
+	if url == "" {
+		return
+	}
+
+	payload := MembershipEvent{
+		Event:          event,
+		Pod:            pod.Name,
+		IP:             pod.Status.PodIP,
+		Timestamp:      time.Now().UTC(),
+		ClusterMembers: members,
+	}
+
+	timeout := time.Duration(p.settings.Notifications.Timeout) * time.Second
+
+	p.webhooks.Add(1)
+
+	go func() {
+		defer p.webhooks.Done()
+
+		err := postJSON(context.Background(), url, payload, timeout)
+		if err != nil {
+			slog.Warn("Failed to send membership webhook", slog.String("url", url), slog.String("event", event), slog.Any("error", err))
+		}
+	}()
+}
+
+// AlertEvent is the payload sent to notifications.alert_webhook_url when every backend goes offline, and again
+// when they recover.
+type AlertEvent struct {
+	Event     string    `json:"event"` // backends_offline or backends_recovered
+	Pod       string    `json:"pod"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message"`
+	Total     int       `json:"backends_total"`
+	Online    int       `json:"backends_online"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Alert on the edges of the all-backends-offline state, rather than on every probe that sees it. Called with
+// probeMu held, which guards backendsOffline.
+func (p *ProxySQL) alertBackendsOffline(results ProbeResult) {
+	url := p.settings.Notifications.AlertWebhookURL
+	if url == "" {
+		return
+	}
+
+	offline := results.Status == "unhealthy"
+	if offline == p.backendsOffline {
+		return
+	}
+
+	p.backendsOffline = offline
+
+	event := "backends_recovered"
+	if offline {
+		event = "backends_offline"
+	}
+
+	hostname, _ := os.Hostname()
+
+	payload := AlertEvent{
+		Event:     event,
+		Pod:       hostname,
+		Status:    results.Status,
+		Message:   results.Message,
+		Total:     results.Backends.Total,
+		Online:    results.Backends.Online,
+		Timestamp: time.Now().UTC(),
+	}
+
+	timeout := time.Duration(p.settings.Notifications.Timeout) * time.Second
+
+	p.webhooks.Add(1)
+
+	go func() {
+		defer p.webhooks.Done()
+
+		err := postJSON(context.Background(), url, payload, timeout)
+		if err != nil {
+			slog.Warn("Failed to send backends alert webhook", slog.String("url", url), slog.String("event", event), slog.Any("error", err))
+		}
+	}()
+}
+
+// POST the payload as JSON to the url, giving up after the timeout.
+func postJSON(ctx context.Context, url string, payload any, timeout time.Duration) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
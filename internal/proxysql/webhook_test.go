@@ -0,0 +1,238 @@
+package proxysql
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetShutdownPhase(t *testing.T) {
+	events := make(chan PhaseEvent, 3)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event PhaseEvent
+
+		err := json.NewDecoder(r.Body).Decode(&event)
+		assert.NoError(t, err)
+
+		events <- event
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	settings := &configuration.Config{}
+	settings.Shutdown.PhaseWebhookURL = server.URL
+
+	p := &ProxySQL{settings: settings}
+
+	assert.False(t, p.IsShuttingDown())
+
+	p.setShutdownPhase(PhaseDraining)
+	p.webhooks.Wait()
+
+	assert.True(t, p.IsShuttingDown())
+	assert.Equal(t, PhaseDraining, p.ShutdownPhase())
+	assert.InDelta(t, 1, testutil.ToFloat64(metrics.ShutdownPhase), 0)
+
+	hostname, _ := os.Hostname()
+
+	event := <-events
+	assert.Equal(t, hostname, event.Pod)
+	assert.Equal(t, "running", event.From)
+	assert.Equal(t, "draining", event.To)
+	assert.WithinDuration(t, time.Now(), event.Timestamp, time.Minute)
+
+	// setting the same phase again doesn't send another event
+	p.setShutdownPhase(PhaseDraining)
+	p.webhooks.Wait()
+
+	assert.Empty(t, events)
+}
+
+func TestSetShutdownPhaseWebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	server.Close() // nothing is listening anymore
+
+	settings := &configuration.Config{}
+	settings.Shutdown.PhaseWebhookURL = server.URL
+
+	p := &ProxySQL{settings: settings}
+
+	start := time.Now()
+
+	p.setShutdownPhase(PhaseStopping)
+
+	// the webhook is delivered in the background, so the phase change itself never blocks
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, PhaseStopping, p.ShutdownPhase())
+
+	p.webhooks.Wait()
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestNotifyMembershipChange(t *testing.T) {
+	events := make(chan MembershipEvent, 1)
+
+	webhookClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var event MembershipEvent
+
+		err := json.NewDecoder(r.Body).Decode(&event)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://hooks.example/cluster", r.URL.String())
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		events <- event
+
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}, nil
+	})}
+	defer func() { webhookClient = http.DefaultClient }()
+
+	settings := &configuration.Config{}
+	settings.Notifications.WebhookURL = "http://hooks.example/cluster"
+	settings.Notifications.Timeout = 5
+
+	p := &ProxySQL{settings: settings}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "proxysql-core-0"},
+		Status:     v1.PodStatus{PodIP: "10.1.2.3"},
+	}
+
+	p.notifyMembershipChange("pod_joined", pod, 3)
+	p.webhooks.Wait()
+
+	event := <-events
+	assert.Equal(t, "pod_joined", event.Event)
+	assert.Equal(t, "proxysql-core-0", event.Pod)
+	assert.Equal(t, "10.1.2.3", event.IP)
+	assert.Equal(t, 3, event.ClusterMembers)
+	assert.WithinDuration(t, time.Now(), event.Timestamp, time.Minute)
+
+	// nothing is sent without a webhook url
+	settings.Notifications.WebhookURL = ""
+
+	p.notifyMembershipChange("pod_left", pod, 2)
+	p.webhooks.Wait()
+
+	assert.Empty(t, events)
+}
+
+func TestAddPodToClusterWebhookFailure(t *testing.T) {
+	webhookClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		time.Sleep(100 * time.Millisecond)
+
+		return nil, errors.New("connection refused")
+	})}
+	defer func() { webhookClient = http.DefaultClient }()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database connection: %v", err)
+	}
+	defer db.Close()
+
+	settings := &configuration.Config{}
+	settings.ProxySQL.Address = "127.0.0.1:6032"
+	settings.Notifications.WebhookURL = "http://hooks.example/cluster"
+	settings.Notifications.Timeout = 5
+
+	p := &ProxySQL{conn: db, settings: settings}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "proxysql-core-0", Labels: map[string]string{"component": "core"}},
+		Status:     v1.PodStatus{PodIP: "10.1.2.3"},
+	}
+
+	mock.ExpectExec("DELETE FROM proxysql_servers").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO proxysql_servers").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for range 6 {
+		mock.ExpectExec("LOAD .* TO RUNTIME").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	expectClusterMembers(mock, 1)
+
+	// the failing webhook is only logged, and doesn't hold up the cluster change
+	err = p.addPodToCluster(pod)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	p.webhooks.Wait()
+}
+
+func TestAlertBackendsOffline(t *testing.T) {
+	events := make(chan AlertEvent, 5)
+
+	webhookClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var event AlertEvent
+
+		err := json.NewDecoder(r.Body).Decode(&event)
+		assert.NoError(t, err)
+
+		events <- event
+
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}, nil
+	})}
+	defer func() { webhookClient = http.DefaultClient }()
+
+	settings := &configuration.Config{}
+	settings.Notifications.AlertWebhookURL = "http://hooks.example/alerts"
+	settings.Notifications.Timeout = 5
+
+	p := &ProxySQL{settings: settings}
+
+	probe := func(total int, online int) {
+		results := ProbeResult{}
+		results.Backends.Total = total
+		results.Backends.Online = online
+
+		p.alertBackendsOffline(processResults(results))
+		p.webhooks.Wait()
+	}
+
+	// healthy to start with, so nothing to alert on
+	probe(3, 3)
+	assert.Empty(t, events)
+
+	probe(3, 0)
+
+	event := <-events
+	assert.Equal(t, "backends_offline", event.Event)
+	assert.Equal(t, "unhealthy", event.Status)
+	assert.Equal(t, 3, event.Total)
+	assert.Equal(t, 0, event.Online)
+	assert.WithinDuration(t, time.Now(), event.Timestamp, time.Minute)
+
+	// still offline; the alert was already sent
+	probe(3, 0)
+	assert.Empty(t, events)
+
+	probe(3, 1)
+
+	event = <-events
+	assert.Equal(t, "backends_recovered", event.Event)
+	assert.Equal(t, 1, event.Online)
+
+	probe(3, 3)
+	assert.Empty(t, events)
+}
@@ -1,15 +1,40 @@
 package restapi
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
-	"os"
-	"strings"
-	"time"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
 
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/logging"
+	"github.com/persona-id/proxysql-agent/internal/metrics"
 	"github.com/persona-id/proxysql-agent/internal/proxysql"
+	"github.com/persona-id/proxysql-agent/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrIncompleteTLSConfig is returned from StartAPI when only one of api.tls.cert_file and api.tls.key_file is set.
+var ErrIncompleteTLSConfig = errors.New("api.tls.cert_file and api.tls.key_file must be set together")
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// ignore client supplied request IDs longer than this, and generate our own instead
+	maxRequestIDLength = 128
 )
 
 // livenessHandler is an HTTP handler function that handles liveness checks for the ProxySQL agent.
@@ -19,12 +44,22 @@ import (
 // If the probes pass, it returns a 200 OK status code.
 // The livenessHandler also logs the status check result for debugging purposes.
 func livenessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		results, err := psql.RunProbes()
+		// once proxysql is being shut down there's nothing left to probe, and nothing in flight to protect
+		if phase := psql.ShutdownPhase(); phase >= proxysql.PhaseStopping {
+			w.WriteHeader(livenessStatusCode(phase, ""))
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprintf(w, `{"message": "proxysql is %s", "status": "stopping", "probe": "liveness"}`, phase)
+
+			return
+		}
+
+		results, err := psql.RunProbes(r.Context())
 		if err != nil {
-			slog.Error("Error in probes()", slog.Any("err", err))
+			slog.ErrorContext(r.Context(), "Error in probes()", slog.Any("err", err))
 
 			w.WriteHeader(http.StatusServiceUnavailable)
 
@@ -38,25 +73,31 @@ func livenessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 
 		resultJSON, err := json.Marshal(results)
 		if err != nil {
-			fmt.Println("Error marshalling JSON:", err)
+			slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
 			return
 		}
 
-		// we want to remain live even during draining, so that we can ensure that the pod
-		// isn't killed while there are queries in flight
-		if results.Status == "ok" || results.Status == "draining" {
-			w.WriteHeader(http.StatusOK)
-		} else {
-			w.WriteHeader(http.StatusServiceUnavailable)
-		}
+		w.WriteHeader(livenessStatusCode(psql.ShutdownPhase(), results.Status))
 
 		// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
 		fmt.Fprint(w, string(resultJSON))
 
-		slog.Debug("status check", slog.String("json", string(resultJSON)))
+		slog.DebugContext(r.Context(), "status check", slog.String("json", string(resultJSON)))
 	}
 }
 
+// We want to remain live even during draining, so that we can ensure that the pod isn't killed while there are
+// queries in flight. The readiness-only failures (isolated satellites, an unhealthy monitor) are still live too,
+// as restarting won't fix them. Once proxysql is stopping though, failing lets the kubelet reap the pod rather
+// than waiting out the rest of the termination grace period.
+func livenessStatusCode(phase proxysql.ShutdownPhase, status string) int {
+	if phase >= proxysql.PhaseStopping || status == "unhealthy" {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusOK
+}
+
 // readinessHandler is an HTTP request handler function that handles the readiness check endpoint.
 // It takes a ProxySQL instance as a parameter and returns an http.HandlerFunc.
 // The readiness check endpoint returns the status of the ProxySQL instance and any error encountered during the probe.
@@ -78,12 +119,12 @@ func livenessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 // that even if a backend is offline, connections to proxysql are accepted; in other words, unless proxysql is paused
 // connections to the serving port with the right creds will succeed.
 func readinessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		results, err := psql.RunProbes()
+		results, err := psql.RunProbes(r.Context())
 		if err != nil {
-			slog.Error("Error in probes()", slog.Any("err", err))
+			slog.ErrorContext(r.Context(), "Error in probes()", slog.Any("err", err))
 
 			w.WriteHeader(http.StatusServiceUnavailable)
 
@@ -97,13 +138,16 @@ func readinessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 
 		resultJSON, err := json.Marshal(results)
 		if err != nil {
-			slog.Error("Error marshaling json", slog.Any("err", err))
+			slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
 			return
 		}
 
 		// we want to remain live even during draining, so that we can ensure that the proxysql container
-		// isn't killed while there are transactions in flight
-		if results.Status == "draining" {
+		// isn't killed while there are transactions in flight. satellites that can't see any core pods
+		// can't route traffic properly, and neither can a pod whose monitor can't reach the backends,
+		// so they aren't ready either. nor is a pod whose backends are all too far behind to serve reads.
+		if results.Status == "draining" || results.Status == "isolated" || results.Status == "monitor_unhealthy" ||
+			results.Status == "lagging" {
 			w.WriteHeader(http.StatusServiceUnavailable)
 		} else {
 			w.WriteHeader(http.StatusOK)
@@ -112,7 +156,7 @@ func readinessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 		// nosemgrep:go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
 		fmt.Fprint(w, string(resultJSON))
 
-		slog.Debug("status check", slog.String("json", string(resultJSON)))
+		slog.DebugContext(r.Context(), "status check", slog.String("json", string(resultJSON)))
 	}
 }
 
@@ -121,19 +165,25 @@ func readinessHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 // is up and listening. This also has the _intended_ side effect of ensuring that
 // the mysql connection to the admin port is open.
 func startupHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		err := psql.Ping()
+		err := psql.Ping(r.Context())
 
-		if err != nil {
+		switch {
+		case errors.Is(err, proxysql.ErrShuttingDown):
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "shutting down", "status": "shutting_down"}`)
+		case err != nil:
 			w.WriteHeader(http.StatusBadGateway)
 
 			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
-			fmt.Fprintf(w, `{"message": %s, "status": "unhealthy"}`, err)
+			fmt.Fprintf(w, `{"message": %q, "status": "unhealthy"}`, err)
 
-			slog.Error("Error in pingHandler()", slog.Any("err", err))
-		} else {
+			slog.ErrorContext(r.Context(), "Error in pingHandler()", slog.Any("err", err))
+		default:
 			w.WriteHeader(http.StatusOK)
 
 			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
@@ -142,129 +192,489 @@ func startupHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
 	}
 }
 
+// backendsHandler returns the contents of runtime_mysql_servers, so that operators can see the backends
+// and their statuses during an incident without having to exec into the pod.
+func backendsHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "method not allowed", "status": "error"}`)
+
+			return
+		}
+
+		backends, err := psql.GetBackends(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error in GetBackends()", slog.Any("err", err))
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprintf(w, `{"message": %q, "status": "error"}`, err)
+
+			return
+		}
+
+		resultJSON, err := json.Marshal(backends)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+		fmt.Fprint(w, string(resultJSON))
+	}
+}
+
+// preStopHandler is used in a container.lifecycle.preStop hook to gracefully drain traffic from the pod before
+// stopping it. It only accepts POST, and kubelet's httpGet hooks send a GET, so the hook has to be an exec that
+// POSTs to it. The request blocks until the shutdown process has finished; once it has, the agent exits with a
+// code that reflects the shutdown outcome.
 func preStopHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		// FIXME: make these configurable
-		shutdownDelay := 120
-		hasCSP := false
-		drainFile := "/var/lib/proxysql/draining"
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-		slog.Info("Pre-stop called, starting shutdown process", slog.Int("shutdownDelay", shutdownDelay))
+		// a stray GET (eg: from a scanner) shouldn't be able to drain the pod
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "use POST to shut down", "status": "method_not_allowed"}`)
+
+			return
+		}
+
+		// the shutdown should run to completion even if the kubelet gives up on the request
+		err := psql.PreStopShutdown(context.WithoutCancel(r.Context()))
+		if errors.Is(err, proxysql.ErrDrainResumed) {
+			w.WriteHeader(http.StatusConflict)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprintf(w, `{"message": %q, "status": "resumed"}`, err)
+
+			return
+		}
 
-		_, err := os.Create(drainFile)
 		if err != nil {
-			slog.Error("Error creating drainFile", slog.String("path", drainFile), slog.Any("err", err))
+			w.WriteHeader(http.StatusInternalServerError)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprintf(w, `{"message": %q, "status": "error"}`, err)
+
+			return
 		}
 
-		// the settings in the proxysql variables are all in ms, so convert shutdownDelay over to MS
-		timeouts := shutdownDelay * int(time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+
+		// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+		fmt.Fprint(w, `{"message": "shutdown complete", "status": "ok"}`)
+	}
+}
+
+// resumeHandler undoes a drain started by /shutdown, eg: one triggered by mistake, so that the pod goes back to
+// serving traffic. It's too late once the drain is over and proxysql is being stopped.
+func resumeHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "use POST to resume", "status": "method_not_allowed"}`)
 
-		// disable new connections
-		commands := []string{
-			fmt.Sprintf("UPDATE global_variables SET variable_value = %d WHERE variable_name in ('mysql-connection_max_age_ms', 'mysql-max_transaction_idle_time', 'mysql-max_transaction_time')", timeouts),
-			"UPDATE global_variables SET variable_value = 1 WHERE variable_name = 'mysql-wait_timeout'",
-			"LOAD MYSQL VARIABLES TO RUNTIME",
-			"PROXYSQL PAUSE;",
+			return
 		}
 
-		for _, command := range commands {
-			_, err = psql.Conn().Exec(command)
-			if err != nil {
-				slog.Error("Command failed", slog.String("commands", command), slog.Any("error", err))
-			}
+		err := psql.Resume(r.Context())
+
+		var status string
+
+		switch {
+		case errors.Is(err, proxysql.ErrNotDraining):
+			status = "not_draining"
+
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, proxysql.ErrShuttingDown):
+			status = "shutting_down"
+
+			w.WriteHeader(http.StatusConflict)
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Error in Resume()", slog.Any("err", err))
+
+			status = "error"
+
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "resumed", "status": "ok"}`)
+
+			return
 		}
 
-		slog.Info("Pre-stop commands ran", slog.String("commands", strings.Join(commands, "; ")))
+		// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+		fmt.Fprintf(w, `{"message": %q, "status": %q}`, err, status)
+	}
+}
 
-		for {
-			if safeToTerminate(psql) {
-				slog.Info("No connected clients remaining, proceeding with shutdown")
-				break
-			}
+// resyncHandler forces a resync without waiting for the loop or restarting the pod, and returns the commands that
+// were run. It does nothing while the pod is shutting down.
+func resyncHandler(psql *proxysql.ProxySQL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-			time.Sleep(10 * time.Second)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "use POST to resync", "status": "method_not_allowed"}`)
+
+			return
+		}
+
+		commands, err := psql.ForceResync(r.Context())
+
+		response := struct {
+			Status   string   `json:"status"`
+			Commands []string `json:"commands"`
+			Error    string   `json:"error,omitempty"`
+		}{Status: "ok", Commands: commands}
+
+		switch {
+		case errors.Is(err, proxysql.ErrShuttingDown):
+			response.Status = "shutting_down"
+			response.Error = err.Error()
+
+			w.WriteHeader(http.StatusConflict)
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Error in ForceResync()", slog.Any("err", err))
+
+			response.Status = "error"
+			response.Error = err.Error()
+
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
 		}
 
-		// issue the PROXYSQL KILL command
-		_, err = psql.Conn().Exec("PROXYSQL KILL")
+		err = json.NewEncoder(w).Encode(response)
 		if err != nil {
-			slog.Error("KILL command failed", slog.String("commands", "PROXYSQL KILL"), slog.Any("error", err))
+			slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
 		}
+	}
+}
 
-		// kill cloud-sql-proxy (CSP) if it exists
-		if hasCSP {
-			err = killCSP()
+// dumpHandler runs a dump on demand and returns where the dumps went: the uploaded objects if an upload
+// destination is configured, otherwise the files it wrote. If some of the tables couldn't be dumped or uploaded,
+// the rest are returned with a 207. Dumps read whole stats tables, so only one runs at a time; requests that arrive
+// while one is running get a 429 rather than queueing up behind it.
+func dumpHandler(dump func(context.Context) ([]string, error)) http.HandlerFunc {
+	var running atomic.Bool
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "use POST to dump", "status": "method_not_allowed"}`)
+
+			return
+		}
+
+		if !running.CompareAndSwap(false, true) {
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "a dump is already running", "status": "busy"}`)
+
+			return
+		}
+
+		defer running.Store(false)
+
+		files, err := dump(r.Context())
+		if errors.Is(err, proxysql.ErrDumpIncomplete) {
+			slog.ErrorContext(r.Context(), "Error in DumpData()", slog.Any("err", err))
+
+			w.WriteHeader(http.StatusMultiStatus)
+
+			err = json.NewEncoder(w).Encode(struct {
+				Message string   `json:"message"`
+				Status  string   `json:"status"`
+				Files   []string `json:"files"`
+			}{err.Error(), "partial", files})
 			if err != nil {
-				slog.Error("Failed to kill CSP", slog.Any("error", err))
+				slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
 			}
+
+			return
 		}
 
-		time.Sleep(10 * time.Second)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error in DumpData()", slog.Any("err", err))
+
+			w.WriteHeader(http.StatusInternalServerError)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprintf(w, `{"message": %q, "status": "error"}`, err)
+
+			return
+		}
 
-		// Return success response
-		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
-		os.Exit(0)
+		err = json.NewEncoder(w).Encode(struct {
+			Status string   `json:"status"`
+			Files  []string `json:"files"`
+		}{"ok", files})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error marshaling json", slog.Any("err", err))
+		}
 	}
 }
 
-func safeToTerminate(psql *proxysql.ProxySQL) bool {
-	// check for connected clients, and when it hits 0 return true
-	clients, err := psql.ProbeClients()
-	if err != nil {
-		slog.Error("Error in probeClients()", slog.Any("err", err))
+// BuildInfo describes the running binary; it's set at build time by goreleaser.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"build_time"`
+}
+
+// versionHandler returns the build info, the Go version and the run mode as JSON, to confirm what's deployed
+// without having to exec into the pod. isLeader is only set with dump.leader_election, and then the response also
+// says whether this agent holds the lease.
+func versionHandler(build BuildInfo, runMode string, isLeader func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var leader *bool
+
+		if isLeader != nil {
+			held := isLeader()
+			leader = &held
+		}
+
+		err := json.NewEncoder(w).Encode(struct {
+			BuildInfo
+			GoVersion string `json:"go_version"`
+			RunMode   string `json:"run_mode"`
+			Leader    *bool  `json:"leader,omitempty"`
+		}{build, runtime.Version(), runMode, leader})
+		if err != nil {
+			slog.Error("Unable to encode the version info", slog.Any("error", err))
+		}
 	}
+}
 
-	if clients > 0 {
-		slog.Info("Clients connected", slog.Int("clients", clients))
+// tracingMiddleware starts a span for each request, continuing the caller's trace if the request has a traceparent
+// header, and passes it on in the request context so that the probes are traced as part of the request.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracing.Tracer().Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.path", r.URL.Path)))
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDMiddleware assigns each request an ID, taken from the X-Request-ID header if the client sent one,
+// or generated otherwise. The ID is stored in the request context, so that it's included in every line logged
+// with the slog.XContext functions while handling the request, and returned in the X-Request-ID response header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := logging.WithRequestID(r.Context(), id)
+
+		slog.DebugContext(ctx, "API request", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+
+	// crypto/rand.Read doesn't return an error on any platform we run on
+	_, _ = rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
+
+// StartAPI starts the HTTP server for the ProxySQL agent.
+// It registers the necessary handlers for health checks and starts listening on the specified port.
+// The listener is bound before StartAPI returns, so a port conflict is returned as an error instead of
+// surfacing later; the server itself runs in the background until it's shut down.
+func StartAPI(p *proxysql.ProxySQL, settings *configuration.Config, build BuildInfo) (*http.Server, error) {
+	// FIXME: make this configurable
+	port := ":8080"
+
+	tlsConfig, err := serverTLSConfig(settings.API.TLS.CertFile, settings.API.TLS.KeyFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// maybe we should also return true if a specified amount of time has passed, in order to not let one rogue transaction hold us up.
+	if settings.API.MetricsEnabled {
+		metrics.Register()
+	}
 
-	return clients == 0
+	return listenAndServe(port, newRouter(p, settings, build), tlsConfig)
 }
 
-// Kill cloud-sql-proxy (CSP) if it is running; this should be optional and configurable,
-// or moved into a plugin down the road.
-func killCSP() error {
-	// Make an HTTP request to localhost:9091/quitquitquit
-	resp, err := http.Get("http://localhost:9091/quitquitquit")
+// Load api.tls.cert_file and api.tls.key_file, if they're set; a nil config means the API is served over plain
+// HTTP. The key pair is loaded here rather than when the server starts, so that a bad certificate stops the
+// agent from starting instead of leaving it without probes.
+func serverTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, ErrIncompleteTLSConfig
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to load the API certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func newRouter(p *proxysql.ProxySQL, settings *configuration.Config, build BuildInfo) http.Handler {
+	mux := http.NewServeMux()
+
+	token := settings.API.AuthToken
+
+	healthToken := token
+	if settings.API.AuthExemptHealth {
+		healthToken = ""
+	}
+
+	mux.HandleFunc("/healthz/started", requireToken(healthToken, requireInitialized(p, startupHandler(p))))
+	mux.HandleFunc("/healthz/ready", requireToken(healthToken, requireInitialized(p, readinessHandler(p))))
+	mux.HandleFunc("/healthz/live", requireToken(healthToken, requireInitialized(p, livenessHandler(p))))
+
+	mux.HandleFunc("/shutdown", requireToken(token, requireInitialized(p, preStopHandler(p))))
+	mux.HandleFunc("/resume", requireToken(token, requireInitialized(p, resumeHandler(p))))
+	mux.HandleFunc("/resync", requireToken(token, requireInitialized(p, resyncHandler(p))))
+	mux.HandleFunc("/dump", requireToken(token, requireInitialized(p, dumpHandler(p.DumpData))))
+
+	mux.HandleFunc("/backends", requireToken(token, requireInitialized(p, backendsHandler(p))))
+
+	// every agent dumps without dump.leader_election, so there's no leader to report
+	var isLeader func() bool
+	if settings.Dump.LeaderElection {
+		isLeader = p.IsLeader
 	}
-	defer resp.Body.Close()
 
-	// Check the response status
-	if resp.StatusCode == http.StatusOK {
-		slog.Info("Killed CSP")
-	} else {
-		slog.Warn("HTTP request to CSP failed", slog.String("status", resp.Status))
+	// doesn't touch proxysql, so it works before the agent has connected
+	mux.HandleFunc("/version", versionHandler(build, settings.RunMode, isLeader))
+
+	if settings.API.PprofEnabled {
+		// pprof.Index serves the named profiles too, eg: /debug/pprof/goroutine
+		mux.HandleFunc("/debug/pprof/", requireToken(token, pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", requireToken(token, pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", requireToken(token, pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", requireToken(token, pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", requireToken(token, pprof.Trace))
 	}
 
-	return nil
+	if settings.API.MetricsEnabled {
+		mux.HandleFunc("/metrics", requireToken(token, metrics.Handler().ServeHTTP))
+	}
+
+	return requestIDMiddleware(tracingMiddleware(mux))
 }
 
-// StartAPI starts the HTTP server for the ProxySQL agent.
-// It registers the necessary handlers for health checks and starts listening on the specified port.
-// The function panics if there is an error starting the server.
-func StartAPI(p *proxysql.ProxySQL) {
-	http.HandleFunc("/healthz/started", startupHandler(p))
-	http.HandleFunc("/healthz/ready", readinessHandler(p))
-	http.HandleFunc("/healthz/live", livenessHandler(p))
+// requireToken returns a 401 instead of calling the handler unless the request has an "Authorization: Bearer
+// <token>" header with the token; an empty token lets every request through.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
 
-	http.HandleFunc("/shutdown", preStopHandler(p))
+	expected := []byte("Bearer " + token)
 
-	// FIXME: make this configurable
-	port := ":8080"
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
 
-	slog.Info("Starting HTTP server", slog.String("port", port))
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "missing or invalid bearer token", "status": "unauthorized"}`)
 
-	// disabling this semgrep rule here because it's an internal API only accessible inside the pod itself
-	// nosemgrep: go.lang.security.audit.net.use-tls.use-tls
-	if err := http.ListenAndServe(port, nil); err != nil {
-		slog.Error("Error starting the HTTP server", slog.Any("err", err))
+			return
+		}
 
-		panic(err)
+		next(w, r)
 	}
 }
+
+// requireInitialized returns a 503 instead of calling the handler when the agent hasn't finished connecting
+// to proxysql, because the handlers would otherwise crash on the missing admin connection.
+func requireInitialized(psql *proxysql.ProxySQL, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !psql.Initialized() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			// nosemgrep: go.lang.security.audit.xss.no-fprintf-to-responsewriter.no-fprintf-to-responsewriter
+			fmt.Fprint(w, `{"message": "agent not initialized", "status": "not_initialized"}`)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func listenAndServe(address string, handler http.Handler, tlsConfig *tls.Config) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to bind the HTTP server to %s: %w", address, err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	slog.Info("Starting HTTP server", slog.String("port", address), slog.Bool("tls", tlsConfig != nil))
+
+	server := &http.Server{Handler: handler}
+
+	go func() {
+		// disabling this semgrep rule here because it's an internal API only accessible inside the pod itself
+		// nosemgrep: go.lang.security.audit.net.use-tls.use-tls
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", slog.Any("err", err))
+		}
+	}()
+
+	return server, nil
+}
@@ -1 +1,503 @@
 package restapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/persona-id/proxysql-agent/internal/logging"
+	"github.com/persona-id/proxysql-agent/internal/proxysql"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+
+	handler := requestIDMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	t.Run("propagates the request id header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/healthz/live", nil)
+		req.Header.Set("X-Request-ID", "kubelet-1234")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, "kubelet-1234", seen)
+		assert.Equal(t, "kubelet-1234", rec.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("generates a request id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/healthz/live", nil)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Len(t, seen, 16)
+		assert.Equal(t, seen, rec.Header().Get("X-Request-ID"))
+	})
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	defer func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "HTTP GET", spans[0].Name())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// grab a free port, and hold it so that binding to it fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	address := listener.Addr().String()
+
+	_, err = listenAndServe(address, handler, nil)
+	assert.Error(t, err)
+
+	listener.Close()
+
+	server, err := listenAndServe(address, handler, nil)
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://" + address + "/healthz/live")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp.Body.Close()
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+
+	_, err = http.Get("http://" + address + "/healthz/live")
+	assert.Error(t, err, "the server should stop accepting connections once it's shut down")
+}
+
+// Write a self signed certificate for 127.0.0.1 and its key to dir, returning their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxysql-agent"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	assert.NoError(t, err)
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	assert.NoError(t, err)
+
+	return certFile, keyFile
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		tlsConfig, err := serverTLSConfig("", "")
+
+		assert.NoError(t, err)
+		assert.Nil(t, tlsConfig)
+	})
+
+	t.Run("only one file", func(t *testing.T) {
+		_, err := serverTLSConfig(certFile, "")
+		assert.ErrorIs(t, err, ErrIncompleteTLSConfig)
+
+		_, err = serverTLSConfig("", keyFile)
+		assert.ErrorIs(t, err, ErrIncompleteTLSConfig)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := serverTLSConfig(certFile, "/nonexistent/key.pem")
+		assert.Error(t, err)
+	})
+
+	t.Run("serves HTTPS", func(t *testing.T) {
+		tlsConfig, err := serverTLSConfig(certFile, keyFile)
+		assert.NoError(t, err)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+
+		address := listener.Addr().String()
+		listener.Close()
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		_, err = listenAndServe(address, handler, tlsConfig)
+		assert.NoError(t, err)
+
+		pool := x509.NewCertPool()
+
+		certPEM, err := os.ReadFile(certFile)
+		assert.NoError(t, err)
+		assert.True(t, pool.AppendCertsFromPEM(certPEM))
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+
+		resp, err := client.Get("https://" + address + "/healthz/live")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp.Body.Close()
+	})
+}
+
+func TestNotInitialized(t *testing.T) {
+	// a ProxySQL that didn't come from New has no admin connection
+	settings := &configuration.Config{}
+	settings.API.MetricsEnabled = true
+
+	router := newRouter(&proxysql.ProxySQL{}, settings, BuildInfo{})
+
+	for _, path := range []string{"/healthz/started", "/healthz/ready", "/healthz/live", "/shutdown", "/resume", "/resync", "/dump", "/backends"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+			assert.JSONEq(t, `{"message": "agent not initialized", "status": "not_initialized"}`, rec.Body.String())
+		})
+	}
+
+	t.Run("/metrics", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	router := newRouter(&proxysql.ProxySQL{}, &configuration.Config{}, BuildInfo{})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRequireToken(t *testing.T) {
+	settings := &configuration.Config{}
+	settings.API.AuthToken = "s3cr3t"
+	settings.API.AuthExemptHealth = true
+
+	// not initialized, so the requests that get past the token check get a 503
+	router := newRouter(&proxysql.ProxySQL{}, settings, BuildInfo{})
+
+	for _, tt := range []struct {
+		path   string
+		header string
+		code   int
+	}{
+		{"/shutdown", "", http.StatusUnauthorized},
+		{"/shutdown", "Bearer wrong", http.StatusUnauthorized},
+		{"/shutdown", "s3cr3t", http.StatusUnauthorized},
+		{"/shutdown", "Bearer s3cr3t", http.StatusServiceUnavailable},
+		{"/backends", "", http.StatusUnauthorized},
+		{"/healthz/live", "", http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.path+"/"+tt.header, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+
+	t.Run("health not exempt", func(t *testing.T) {
+		settings.API.AuthExemptHealth = false
+
+		router := newRouter(&proxysql.ProxySQL{}, settings, BuildInfo{})
+
+		req := httptest.NewRequest(http.MethodGet, "/healthz/live", nil)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestPprof(t *testing.T) {
+	settings := &configuration.Config{}
+
+	for _, tt := range []struct {
+		enabled bool
+		code    int
+	}{
+		{false, http.StatusNotFound},
+		{true, http.StatusOK},
+	} {
+		settings.API.PprofEnabled = tt.enabled
+
+		router := newRouter(&proxysql.ProxySQL{}, settings, BuildInfo{})
+
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.code, rec.Code, "%s with pprof_enabled=%t", path, tt.enabled)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	settings := &configuration.Config{RunMode: "satellite"}
+
+	// served even before the agent has connected to proxysql
+	router := newRouter(&proxysql.ProxySQL{}, settings, BuildInfo{Version: "v1.2.3", Commit: "abc123", Date: "2026-01-02T03:04:05Z"})
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"version": "v1.2.3",
+		"commit": "abc123",
+		"build_time": "2026-01-02T03:04:05Z",
+		"go_version": "`+runtime.Version()+`",
+		"run_mode": "satellite"
+	}`, rec.Body.String())
+
+	t.Run("leader election", func(t *testing.T) {
+		for _, leader := range []bool{true, false} {
+			handler := versionHandler(BuildInfo{Version: "v1.2.3"}, "dump", func() bool { return leader })
+
+			req := httptest.NewRequest(http.MethodGet, "/version", nil)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, fmt.Sprintf(`{
+				"version": "v1.2.3",
+				"commit": "",
+				"build_time": "",
+				"go_version": "%s",
+				"run_mode": "dump",
+				"leader": %t
+			}`, runtime.Version(), leader), rec.Body.String())
+		}
+	})
+}
+
+func TestPreStopHandlerMethod(t *testing.T) {
+	// a ProxySQL that didn't come from New can't shut down, so reaching PreStopShutdown would panic
+	handler := preStopHandler(&proxysql.ProxySQL{})
+
+	req := httptest.NewRequest(http.MethodGet, "/shutdown", nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+	assert.JSONEq(t, `{"message": "use POST to shut down", "status": "method_not_allowed"}`, rec.Body.String())
+}
+
+func TestResumeHandler(t *testing.T) {
+	handler := resumeHandler(&proxysql.ProxySQL{})
+
+	t.Run("method", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/resume", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+		assert.JSONEq(t, `{"message": "use POST to resume", "status": "method_not_allowed"}`, rec.Body.String())
+	})
+
+	t.Run("not draining", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/resume", nil))
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.JSONEq(t, `{"message": "proxysql is not draining", "status": "not_draining"}`, rec.Body.String())
+	})
+}
+
+func TestResyncHandlerMethod(t *testing.T) {
+	handler := resyncHandler(&proxysql.ProxySQL{})
+
+	req := httptest.NewRequest(http.MethodGet, "/resync", nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodPost, rec.Header().Get("Allow"))
+	assert.JSONEq(t, `{"message": "use POST to resync", "status": "method_not_allowed"}`, rec.Body.String())
+}
+
+func TestDumpHandler(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	handler := dumpHandler(func(context.Context) ([]string, error) {
+		close(started)
+		<-release
+
+		return []string{"/tmp/dump/proxysql-core-0-digests.csv"}, nil
+	})
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		handler.ServeHTTP(first, httptest.NewRequest(http.MethodPost, "/dump", nil))
+	}()
+
+	<-started
+
+	// the first dump is still running
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest(http.MethodPost, "/dump", nil))
+
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.JSONEq(t, `{"message": "a dump is already running", "status": "busy"}`, second.Body.String())
+
+	close(release)
+	<-done
+
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.JSONEq(t, `{"status": "ok", "files": ["/tmp/dump/proxysql-core-0-digests.csv"]}`, first.Body.String())
+
+	t.Run("method", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dump", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		handler := dumpHandler(func(context.Context) ([]string, error) {
+			return nil, errors.New("dump.output_dir is not writable")
+		})
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/dump", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.JSONEq(t, `{"message": "dump.output_dir is not writable", "status": "error"}`, rec.Body.String())
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		handler := dumpHandler(func(context.Context) ([]string, error) {
+			return []string{"s3://proxysql-dumps/proxysql-core-0/20240102T030405Z/proxysql-core-0-digests.csv"},
+				fmt.Errorf("%w: unable to dump query_rules: database is locked", proxysql.ErrDumpIncomplete)
+		})
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/dump", nil))
+
+		assert.Equal(t, http.StatusMultiStatus, rec.Code)
+		assert.JSONEq(t, `{
+			"message": "dump incomplete: unable to dump query_rules: database is locked",
+			"status": "partial",
+			"files": ["s3://proxysql-dumps/proxysql-core-0/20240102T030405Z/proxysql-core-0-digests.csv"]
+		}`, rec.Body.String())
+	})
+}
+
+func TestLivenessStatusCode(t *testing.T) {
+	for _, tt := range []struct {
+		phase  proxysql.ShutdownPhase
+		status string
+		code   int
+	}{
+		{proxysql.PhaseRunning, "ok", http.StatusOK},
+		{proxysql.PhaseRunning, "isolated", http.StatusOK},
+		{proxysql.PhaseRunning, "unhealthy", http.StatusServiceUnavailable},
+		{proxysql.PhaseDraining, "draining", http.StatusOK},
+		{proxysql.PhaseStopping, "", http.StatusServiceUnavailable},
+		{proxysql.PhaseStopped, "", http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.phase.String()+"/"+tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.code, livenessStatusCode(tt.phase, tt.status))
+		})
+	}
+}
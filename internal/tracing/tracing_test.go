@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/persona-id/proxysql-agent/internal/configuration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupDisabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), &configuration.Config{})
+
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	// without a provider, the spans aren't recorded
+	_, span := Tracer().Start(context.Background(), "test")
+	defer span.End()
+
+	assert.False(t, span.IsRecording())
+}
+
+func TestSetup(t *testing.T) {
+	settings := &configuration.Config{RunMode: "satellite"}
+	settings.Tracing.Enabled = true
+	settings.Tracing.Endpoint = "http://127.0.0.1:4318"
+	settings.Tracing.SampleRate = 1
+
+	shutdown, err := Setup(context.Background(), settings)
+	assert.NoError(t, err)
+
+	_, span := Tracer().Start(context.Background(), "test")
+	assert.True(t, span.IsRecording())
+	span.End()
+
+	// nothing is listening on the endpoint, so only check that the flush returns rather than that it succeeds
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = shutdown(ctx)
+}